@@ -0,0 +1,172 @@
+package psync
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+)
+
+// DefaultBackupSuffix is appended to the names of the backups made next
+// to the files they are backups of.
+const DefaultBackupSuffix = "~"
+
+// backupTimeFormat names the per sync subdirectories of the backup
+// directory.
+const backupTimeFormat = "2006-01-02_15-04-05"
+
+var errBackupDir = errors.New("backup directory must be a relative path inside the root directory")
+
+// backupPath returns the path the file at rel, relative to the root
+// directory, is moved to when it is backed up.
+func (r *Receiver) backupPath(rel string) (string, error) {
+	suffix := r.Opts.BackupSuffix
+	if r.Opts.BackupDir == "" {
+		if suffix == "" {
+			suffix = DefaultBackupSuffix
+		}
+		return filepath.Join(r.Root, rel+suffix), nil
+	}
+	dir, err := r.localDir(r.Opts.BackupDir, errBackupDir)
+	if err != nil {
+		return "", err
+	}
+	if r.Opts.BackupTimestamp {
+		dir = filepath.Join(dir, r.SyncTime.Format(backupTimeFormat))
+	}
+	return filepath.Join(dir, rel+suffix), nil
+}
+
+// backup moves the file at rel out of the way, before it is replaced
+// or deleted, if backups are enabled. An existing backup of the file is
+// replaced. It reports whether the file has been moved.
+func (r *Receiver) backup(rel string) (bool, error) {
+	if !r.Opts.Backup {
+		return false, nil
+	}
+	name := filepath.Join(r.Root, rel)
+	if _, err := os.Lstat(name); os.IsNotExist(err) {
+		return false, nil
+	}
+	bak, err := r.backupPath(rel)
+	if err != nil {
+		return false, err
+	}
+	if err := os.MkdirAll(filepath.Dir(bak), 0755); err != nil {
+		return false, err
+	}
+	if err := os.RemoveAll(bak); err != nil {
+		return false, err
+	}
+	if err := os.Rename(name, bak); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// backupCopy copies the file at rel to its backup, if backups are
+// enabled, as it is about to be updated in place.
+func (r *Receiver) backupCopy(rel string) error {
+	if !r.Opts.Backup {
+		return nil
+	}
+	bak, err := r.backupPath(rel)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(bak), 0755); err != nil {
+		return err
+	}
+	src, err := os.Open(filepath.Join(r.Root, rel))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(bak); err != nil {
+		return err
+	}
+	dst, err := os.OpenFile(bak, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(bak, info.ModTime(), info.ModTime())
+}
+
+// removeAll removes the file at rel, after backing it up if backups are
+// enabled. The files in a directory are backed up one by one, and the
+// directories holding their backups are left in place.
+func (r *Receiver) removeAll(rel string) error {
+	name := filepath.Join(r.Root, rel)
+	if !r.Opts.Backup {
+		return os.RemoveAll(name)
+	}
+	backups, err := NewFilter(r.backupRules())
+	if err != nil {
+		return err
+	}
+	var dirs []string
+	err = filepath.Walk(name, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(r.Root, path)
+		if err != nil {
+			return err
+		}
+		if backups.Excluded(filepath.ToSlash(rel), info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			dirs = append(dirs, path)
+			return nil
+		}
+		_, err = r.backup(rel)
+		return err
+	})
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		err := os.Remove(dirs[i])
+		if err != nil && !errors.Is(err, syscall.ENOTEMPTY) && !errors.Is(err, syscall.EEXIST) {
+			return err
+		}
+	}
+	return nil
+}
+
+// backupRules returns the rules protecting the backups from being
+// deleted as extraneous files.
+func (r *Receiver) backupRules() []Rule {
+	if !r.Opts.Backup {
+		return nil
+	}
+	if r.Opts.BackupDir == "" {
+		suffix := r.Opts.BackupSuffix
+		if suffix == "" {
+			suffix = DefaultBackupSuffix
+		}
+		return []Rule{{Pattern: "*" + suffix}}
+	}
+	dir := path.Clean(filepath.ToSlash(r.Opts.BackupDir))
+	return []Rule{{Pattern: "/" + dir + "/"}}
+}
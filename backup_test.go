@@ -0,0 +1,98 @@
+package psync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDeleteExtraBackup(t *testing.T) {
+	now := time.Date(2020, 5, 17, 10, 4, 5, 0, time.UTC)
+	tests := []struct {
+		opts Options
+		want []string
+	}{
+		{
+			Options{Backup: true},
+			[]string{"dir/extra~", "extra~", "keep", "old/a~"},
+		},
+		{
+			Options{Backup: true, BackupSuffix: ".bak"},
+			[]string{"dir/extra.bak", "extra.bak", "keep", "old/a.bak"},
+		},
+		{
+			Options{Backup: true, BackupDir: "backup"},
+			[]string{"backup/dir/extra", "backup/extra", "backup/old/a", "keep"},
+		},
+		{
+			Options{Backup: true, BackupDir: "backup", BackupTimestamp: true},
+			[]string{
+				"backup/2020-05-17_10-04-05/dir/extra",
+				"backup/2020-05-17_10-04-05/extra",
+				"backup/2020-05-17_10-04-05/old/a",
+				"keep",
+			},
+		},
+	}
+	for _, tt := range tests {
+		root, err := ioutil.TempDir("", "psync")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(root)
+		for _, p := range []string{"keep", "extra", "dir/extra", "old/a"} {
+			p = filepath.Join(root, p)
+			if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(p, []byte(p), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		list := []ReceiverSrcFile{{SrcFile: SrcFile{Path: "keep"}}}
+		rcv := Receiver{Root: root, Opts: tt.opts, SyncTime: now}
+		var res Result
+		if err := rcv.DeleteExtra(list, &res); err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Failed) != 0 {
+			t.Errorf("%+v: DeleteExtra(...) failed: %v", tt.opts, res.Failed)
+		}
+		// the backups survive the next sync
+		res = Result{}
+		if err := rcv.DeleteExtra(list, &res); err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Deleted) != 0 {
+			t.Errorf("%+v: backups deleted: %v", tt.opts, res.Deleted)
+		}
+		var got []string
+		err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			rel, _ := filepath.Rel(root, path)
+			got = append(got, filepath.ToSlash(rel))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(tt.want, got); diff != "" {
+			t.Errorf("%+v: files mismatch (-want +got):\n%s", tt.opts, diff)
+		}
+	}
+}
+
+func TestBackupDirInvalid(t *testing.T) {
+	for _, dir := range []string{"/tmp/bak", "..", "../bak", "."} {
+		rcv := Receiver{Root: "/root", Opts: Options{Backup: true, BackupDir: dir}}
+		if _, err := rcv.backupPath("a"); err != errBackupDir {
+			t.Errorf("backupPath with backup dir %q: got %v, want %v", dir, err, errBackupDir)
+		}
+	}
+}
@@ -0,0 +1,618 @@
+package psync
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Every message in the binary wire format is framed as a one byte tag,
+// followed by the uvarint encoded length of the payload and the payload
+// itself. Integers in the payload are varint encoded, byte slices and
+// strings are prefixed with their uvarint encoded length. Raw file data
+// written through EncodeWriter is not framed at all.
+type msgTag byte
+
+const (
+	tagFileListHdr msgTag = iota + 1
+	tagSrcFile
+	tagFileDesc
+	tagDstFile
+	tagBlockSum
+	tagBlockType
+	tagLocalBlock
+	tagRemoteBlock
+	tagBytes
+	tagResult
+	tagOptions
+)
+
+// maxFrameSize guards against allocating absurd amounts of memory when
+// the stream is corrupted.
+const maxFrameSize = 1 << 24
+
+var errShortFrame = errors.New("binary: short frame")
+
+type binaryEncoder struct {
+	w   io.Writer
+	buf []byte
+	p   payload
+}
+
+func newBinaryEncoder(w io.Writer) *binaryEncoder {
+	return &binaryEncoder{w: w}
+}
+
+func (e *binaryEncoder) Write(p []byte) (int, error) { return e.w.Write(p) }
+
+func (e *binaryEncoder) Encode(v interface{}) error {
+	e.p = e.p[:0]
+	var tag msgTag
+	switch m := v.(type) {
+	case *FileListHdr:
+		tag = tagFileListHdr
+		e.p.putFileListHdr(m)
+	case FileListHdr:
+		tag = tagFileListHdr
+		e.p.putFileListHdr(&m)
+	case *SrcFile:
+		tag = tagSrcFile
+		if err := e.p.putSrcFile(m); err != nil {
+			return err
+		}
+	case SrcFile:
+		tag = tagSrcFile
+		if err := e.p.putSrcFile(&m); err != nil {
+			return err
+		}
+	case *FileDesc:
+		tag = tagFileDesc
+		e.p.putFileDesc(m)
+	case FileDesc:
+		tag = tagFileDesc
+		e.p.putFileDesc(&m)
+	case *DstFile:
+		tag = tagDstFile
+		e.p.putDstFile(m)
+	case DstFile:
+		tag = tagDstFile
+		e.p.putDstFile(&m)
+	case *BlockSum:
+		tag = tagBlockSum
+		e.p.putBlockSum(m)
+	case BlockSum:
+		tag = tagBlockSum
+		e.p.putBlockSum(&m)
+	case BlockType:
+		tag = tagBlockType
+		e.p.putUvarint(uint64(m))
+	case *LocalBlock:
+		tag = tagLocalBlock
+		e.p.putLocalBlock(m)
+	case LocalBlock:
+		tag = tagLocalBlock
+		e.p.putLocalBlock(&m)
+	case *RemoteBlock:
+		tag = tagRemoteBlock
+		e.p.putRemoteBlock(m)
+	case RemoteBlock:
+		tag = tagRemoteBlock
+		e.p.putRemoteBlock(&m)
+	case []byte:
+		tag = tagBytes
+		e.p.putBytes(m)
+	case *Result:
+		tag = tagResult
+		e.p.putResult(m)
+	case Result:
+		tag = tagResult
+		e.p.putResult(&m)
+	case *Options:
+		tag = tagOptions
+		e.p.putOptions(m)
+	case Options:
+		tag = tagOptions
+		e.p.putOptions(&m)
+	default:
+		return fmt.Errorf("binary: cannot encode %T", v)
+	}
+	var n [binary.MaxVarintLen64]byte
+	e.buf = append(e.buf[:0], byte(tag))
+	e.buf = append(e.buf, n[:binary.PutUvarint(n[:], uint64(len(e.p)))]...)
+	e.buf = append(e.buf, e.p...)
+	_, err := e.w.Write(e.buf)
+	return err
+}
+
+type binaryDecoder struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+func newBinaryDecoder(r io.Reader) *binaryDecoder {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &binaryDecoder{r: br}
+}
+
+func (d *binaryDecoder) Read(p []byte) (int, error) { return d.r.Read(p) }
+
+func (d *binaryDecoder) Decode(v interface{}) error {
+	var want msgTag
+	switch v.(type) {
+	case *FileListHdr:
+		want = tagFileListHdr
+	case *SrcFile:
+		want = tagSrcFile
+	case *FileDesc:
+		want = tagFileDesc
+	case *DstFile:
+		want = tagDstFile
+	case *BlockSum:
+		want = tagBlockSum
+	case *BlockType:
+		want = tagBlockType
+	case *LocalBlock:
+		want = tagLocalBlock
+	case *RemoteBlock:
+		want = tagRemoteBlock
+	case *[]byte:
+		want = tagBytes
+	case *Result:
+		want = tagResult
+	case *Options:
+		want = tagOptions
+	default:
+		return fmt.Errorf("binary: cannot decode into %T", v)
+	}
+	p, err := d.readFrame(want)
+	if err != nil {
+		return err
+	}
+	switch m := v.(type) {
+	case *FileListHdr:
+		p.getFileListHdr(m)
+	case *SrcFile:
+		p.getSrcFile(m)
+	case *FileDesc:
+		p.getFileDesc(m)
+	case *DstFile:
+		p.getDstFile(m)
+	case *BlockSum:
+		p.getBlockSum(m)
+	case *BlockType:
+		*m = BlockType(p.uvarint())
+	case *LocalBlock:
+		p.getLocalBlock(m)
+	case *RemoteBlock:
+		p.getRemoteBlock(m)
+	case *[]byte:
+		*m = p.bytes()
+	case *Result:
+		p.getResult(m)
+	case *Options:
+		p.getOptions(m)
+	}
+	return p.err
+}
+
+func (d *binaryDecoder) readFrame(want msgTag) (*payloadReader, error) {
+	tag, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if msgTag(tag) != want {
+		return nil, fmt.Errorf("binary: unexpected message tag: got %d, want %d", tag, want)
+	}
+	n, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if n > maxFrameSize {
+		return nil, fmt.Errorf("binary: frame too large: %d bytes", n)
+	}
+	if uint64(cap(d.buf)) < n {
+		d.buf = make([]byte, n)
+	}
+	d.buf = d.buf[:n]
+	if _, err := io.ReadFull(d.r, d.buf); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return &payloadReader{p: d.buf}, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// payload accumulates the body of a single frame.
+type payload []byte
+
+func (p *payload) putUvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	*p = append(*p, b[:binary.PutUvarint(b[:], v)]...)
+}
+
+func (p *payload) putVarint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	*p = append(*p, b[:binary.PutVarint(b[:], v)]...)
+}
+
+func (p *payload) putBool(v bool) {
+	if v {
+		*p = append(*p, 1)
+		return
+	}
+	*p = append(*p, 0)
+}
+
+func (p *payload) putBytes(b []byte) {
+	p.putUvarint(uint64(len(b)))
+	*p = append(*p, b...)
+}
+
+func (p *payload) putString(s string) {
+	p.putUvarint(uint64(len(s)))
+	*p = append(*p, s...)
+}
+
+func (p *payload) putStrings(l []string) {
+	p.putUvarint(uint64(len(l)))
+	for _, s := range l {
+		p.putString(s)
+	}
+}
+
+func (p *payload) putTime(t time.Time) error {
+	b, err := t.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	p.putBytes(b)
+	return nil
+}
+
+func (p *payload) putFileListHdr(h *FileListHdr) {
+	p.putVarint(int64(h.NumFiles))
+	p.putUvarint(uint64(h.Type))
+	p.putBool(h.DeleteExtra)
+}
+
+func (p *payload) putSrcFile(f *SrcFile) error {
+	p.putString(f.Path)
+	p.putVarint(int64(f.Uid))
+	p.putVarint(int64(f.Gid))
+	p.putUvarint(uint64(f.Mode))
+	p.putVarint(f.Size)
+	if err := p.putTime(f.Mtime); err != nil {
+		return err
+	}
+	p.putString(f.User)
+	p.putString(f.Group)
+	p.putString(f.Target)
+	p.putUvarint(f.Rdev)
+	p.putBool(f.Skipped)
+	p.putUvarint(uint64(f.Leader))
+	p.putUvarint(uint64(len(f.Xattrs)))
+	for _, x := range f.Xattrs {
+		p.putString(x.Name)
+		p.putBytes(x.Value)
+	}
+	return nil
+}
+
+func (p *payload) putFileDesc(f *FileDesc) {
+	p.putVarint(int64(f.ID))
+	p.putUvarint(uint64(f.Typ))
+	p.putVarint(f.TotalSize)
+}
+
+func (p *payload) putDstFile(f *DstFile) {
+	p.putVarint(int64(f.ID))
+	p.putVarint(int64(f.ChunkSize))
+	p.putVarint(f.Size)
+	p.putVarint(int64(f.Type))
+	p.putBytes(f.Sum)
+	p.putUvarint(uint64(f.Changes))
+}
+
+func (p *payload) putBlockSum(b *BlockSum) {
+	var s [4]byte
+	binary.BigEndian.PutUint32(s[:], b.Rsum)
+	*p = append(*p, s[:]...)
+	p.putBytes(b.Csum)
+}
+
+func (p *payload) putLocalBlock(b *LocalBlock) {
+	p.putVarint(b.Size)
+	p.putVarint(b.Off)
+}
+
+func (p *payload) putRemoteBlock(b *RemoteBlock) {
+	p.putVarint(int64(b.ChunkID))
+	p.putVarint(int64(b.NrChunks))
+	p.putVarint(b.Off)
+}
+
+func (p *payload) putResult(r *Result) {
+	p.putStrings(r.Created)
+	p.putStrings(r.Updated)
+	p.putStrings(r.Deleted)
+	p.putUvarint(uint64(len(r.Failed)))
+	for i := range r.Failed {
+		f := &r.Failed[i]
+		p.putString(f.Path)
+		p.putUvarint(uint64(f.Code))
+		p.putString(f.Err)
+	}
+	p.putBool(r.More)
+}
+
+func (p *payload) putOptions(o *Options) {
+	p.putBool(o.Owner)
+	p.putBool(o.Group)
+	p.putBool(o.Checksum)
+	p.putBool(o.DryRun)
+	rules := make([]string, len(o.Filter))
+	for i, r := range o.Filter {
+		rules[i] = r.String()
+	}
+	p.putStrings(rules)
+	p.putBool(o.DeleteExcluded)
+	p.putStrings(o.IgnoreFiles)
+	p.putUvarint(uint64(o.Delete))
+	p.putVarint(int64(o.MaxDelete))
+	rules = make([]string, len(o.Protect))
+	for i, r := range o.Protect {
+		rules[i] = r.String()
+	}
+	p.putStrings(rules)
+	p.putBool(o.Backup)
+	p.putString(o.BackupSuffix)
+	p.putString(o.BackupDir)
+	p.putBool(o.BackupTimestamp)
+	p.putString(o.TempDir)
+	p.putBool(o.DelayUpdates)
+	p.putBool(o.Inplace)
+	p.putBool(o.Partial)
+	p.putString(o.PartialDir)
+	p.putBool(o.Sparse)
+	p.putBool(o.Xattrs)
+	p.putBool(o.ACLs)
+	p.putBool(o.Devices)
+	p.putBool(o.Specials)
+	p.putBool(o.SizeOnly)
+	p.putBool(o.IgnoreTimes)
+	p.putBool(o.Update)
+	p.putBool(o.IgnoreExisting)
+	p.putBool(o.Existing)
+	p.putVarint(int64(o.ModifyWindow))
+}
+
+// payloadReader parses the body of a single frame. The first error is
+// sticky and all the subsequent reads return zero values. Running out
+// of payload is not an error, fields appended to a message by later
+// versions of the protocol simply decode as zero values.
+type payloadReader struct {
+	p   []byte
+	err error
+}
+
+func (r *payloadReader) uvarint() uint64 {
+	if r.err != nil || len(r.p) == 0 {
+		return 0
+	}
+	v, n := binary.Uvarint(r.p)
+	if n <= 0 {
+		r.err = errShortFrame
+		return 0
+	}
+	r.p = r.p[n:]
+	return v
+}
+
+func (r *payloadReader) varint() int64 {
+	if r.err != nil || len(r.p) == 0 {
+		return 0
+	}
+	v, n := binary.Varint(r.p)
+	if n <= 0 {
+		r.err = errShortFrame
+		return 0
+	}
+	r.p = r.p[n:]
+	return v
+}
+
+func (r *payloadReader) bool() bool { return r.uvarint() != 0 }
+
+func (r *payloadReader) next(n uint64) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if uint64(len(r.p)) < n {
+		r.err = errShortFrame
+		return nil
+	}
+	b := r.p[:n]
+	r.p = r.p[n:]
+	return b
+}
+
+// bytes returns a copy of the next length prefixed byte slice, as the
+// frame buffer gets reused by the following Decode call.
+func (r *payloadReader) bytes() []byte {
+	n := r.uvarint()
+	b := r.next(n)
+	if len(b) == 0 {
+		return nil
+	}
+	return append([]byte(nil), b...)
+}
+
+func (r *payloadReader) string() string { return string(r.next(r.uvarint())) }
+
+func (r *payloadReader) strings() []string {
+	n := r.uvarint()
+	if n == 0 {
+		return nil
+	}
+	if n > uint64(len(r.p)) {
+		r.err = errShortFrame
+		return nil
+	}
+	l := make([]string, n)
+	for i := range l {
+		l[i] = r.string()
+	}
+	return l
+}
+
+func (r *payloadReader) time() time.Time {
+	var t time.Time
+	b := r.next(r.uvarint())
+	if len(b) == 0 {
+		return t
+	}
+	if err := t.UnmarshalBinary(b); err != nil && r.err == nil {
+		r.err = err
+	}
+	return t
+}
+
+func (r *payloadReader) getFileListHdr(h *FileListHdr) {
+	h.NumFiles = int(r.varint())
+	h.Type = FileListType(r.uvarint())
+	h.DeleteExtra = r.bool()
+}
+
+func (r *payloadReader) getSrcFile(f *SrcFile) {
+	f.Path = r.string()
+	f.Uid = int(r.varint())
+	f.Gid = int(r.varint())
+	f.Mode = os.FileMode(r.uvarint())
+	f.Size = r.varint()
+	f.Mtime = r.time()
+	f.User = r.string()
+	f.Group = r.string()
+	f.Target = r.string()
+	f.Rdev = r.uvarint()
+	f.Skipped = r.bool()
+	f.Leader = int(r.uvarint())
+	f.Xattrs = nil
+	n := r.uvarint()
+	if n == 0 {
+		return
+	}
+	if n > uint64(len(r.p)) {
+		r.err = errShortFrame
+		return
+	}
+	f.Xattrs = make([]Xattr, n)
+	for i := range f.Xattrs {
+		f.Xattrs[i] = Xattr{Name: r.string(), Value: r.bytes()}
+	}
+}
+
+func (r *payloadReader) getFileDesc(f *FileDesc) {
+	f.ID = int(r.varint())
+	f.Typ = FileType(r.uvarint())
+	f.TotalSize = r.varint()
+}
+
+func (r *payloadReader) getDstFile(f *DstFile) {
+	f.ID = int(r.varint())
+	f.ChunkSize = int(r.varint())
+	f.Size = r.varint()
+	f.Type = DstFileType(r.varint())
+	f.Sum = r.bytes()
+	f.Changes = Changes(r.uvarint())
+}
+
+func (r *payloadReader) getBlockSum(b *BlockSum) {
+	if s := r.next(4); len(s) == 4 {
+		b.Rsum = binary.BigEndian.Uint32(s)
+	}
+	b.Csum = r.bytes()
+}
+
+func (r *payloadReader) getLocalBlock(b *LocalBlock) {
+	b.Size = r.varint()
+	b.Off = r.varint()
+}
+
+func (r *payloadReader) getRemoteBlock(b *RemoteBlock) {
+	b.ChunkID = int(r.varint())
+	b.NrChunks = int(r.varint())
+	b.Off = r.varint()
+}
+
+func (r *payloadReader) getResult(res *Result) {
+	res.Created = r.strings()
+	res.Updated = r.strings()
+	res.Deleted = r.strings()
+	res.Failed = nil
+	n := r.uvarint()
+	if n > uint64(len(r.p)) {
+		r.err = errShortFrame
+		return
+	}
+	if n > 0 {
+		res.Failed = make([]FileError, n)
+	}
+	for i := range res.Failed {
+		f := &res.Failed[i]
+		f.Path = r.string()
+		f.Code = ErrorCode(r.uvarint())
+		f.Err = r.string()
+	}
+	res.More = r.bool()
+}
+
+func (r *payloadReader) getOptions(o *Options) {
+	o.Owner = r.bool()
+	o.Group = r.bool()
+	o.Checksum = r.bool()
+	o.DryRun = r.bool()
+	o.Filter = nil
+	for _, s := range r.strings() {
+		o.Filter = append(o.Filter, ParseRule(s))
+	}
+	o.DeleteExcluded = r.bool()
+	o.IgnoreFiles = r.strings()
+	o.Delete = DeleteTiming(r.uvarint())
+	o.MaxDelete = int(r.varint())
+	o.Protect = nil
+	for _, s := range r.strings() {
+		o.Protect = append(o.Protect, ParseRule(s))
+	}
+	o.Backup = r.bool()
+	o.BackupSuffix = r.string()
+	o.BackupDir = r.string()
+	o.BackupTimestamp = r.bool()
+	o.TempDir = r.string()
+	o.DelayUpdates = r.bool()
+	o.Inplace = r.bool()
+	o.Partial = r.bool()
+	o.PartialDir = r.string()
+	o.Sparse = r.bool()
+	o.Xattrs = r.bool()
+	o.ACLs = r.bool()
+	o.Devices = r.bool()
+	o.Specials = r.bool()
+	o.SizeOnly = r.bool()
+	o.IgnoreTimes = r.bool()
+	o.Update = r.bool()
+	o.IgnoreExisting = r.bool()
+	o.Existing = r.bool()
+	o.ModifyWindow = time.Duration(r.varint())
+}
@@ -0,0 +1,176 @@
+package psync
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestBinaryRoundTrip(t *testing.T) {
+	digest := func(s string) []byte { return digest(t, s) }
+	mtime := time.Date(2021, 1, 24, 15, 45, 48, 120, time.UTC)
+	in := []interface{}{
+		&FileListHdr{NumFiles: 2, Type: SenderFileList, DeleteExtra: true},
+		&SrcFile{
+			Path:  "path/to/file1.bin",
+			Uid:   1000,
+			Gid:   1003,
+			Mode:  0644,
+			Size:  233348971,
+			Mtime: mtime,
+		},
+		&SrcFile{Path: "path/to/huge.img", Mode: 0644, Size: 1 << 40, Skipped: true},
+		&SrcFile{
+			Path:   "path/to/dir",
+			Mode:   0755 | 1<<31,
+			Xattrs: []Xattr{{Name: "security.selinux", Value: []byte("system_u:object_r:etc_t:s0")}},
+		},
+		&DstFile{ID: 1, ChunkSize: 8, Size: 57},
+		&BlockSum{Rsum: 0x071c019d, Csum: digest("2e9ec317e197819358fbc43afca7d837")},
+		&FileDesc{ID: 22, Typ: PartialFile},
+		LocalBlockType,
+		&LocalBlock{Size: 8, Off: 24},
+		[]byte("mnop-mod"),
+		RemoteBlockType,
+		&RemoteBlock{ChunkID: 5, NrChunks: 3, Off: 42},
+		FileSum,
+		digest("68b329da9893e34099c7d8ad5cb9c940"),
+		&Result{
+			Created: []string{"path/to/file1.bin"},
+			Deleted: []string{"path/to/old", "path/to/older"},
+			Failed: []FileError{
+				{Path: "path/to/dir", Code: CodePermission, Err: "permission denied"},
+			},
+		},
+	}
+	var b bytes.Buffer
+	enc := newBinaryEncoder(&b)
+	btype := RemoteBlockType
+	for _, v := range in {
+		var err error
+		switch y := v.(type) {
+		case BlockType:
+			btype = y
+		case []byte:
+			if btype != FileSum {
+				_, err = enc.Write(y)
+				if err != nil {
+					t.Fatal(err)
+				}
+				continue
+			}
+		}
+		if err = enc.Encode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dec := newBinaryDecoder(&b)
+	var got []interface{}
+	btype = RemoteBlockType
+	for _, v := range in {
+		var err error
+		switch y := v.(type) {
+		case *FileListHdr:
+			var m FileListHdr
+			err = dec.Decode(&m)
+			got = append(got, &m)
+		case *SrcFile:
+			var m SrcFile
+			err = dec.Decode(&m)
+			got = append(got, &m)
+		case *DstFile:
+			var m DstFile
+			err = dec.Decode(&m)
+			got = append(got, &m)
+		case *BlockSum:
+			var m BlockSum
+			err = dec.Decode(&m)
+			got = append(got, &m)
+		case *FileDesc:
+			var m FileDesc
+			err = dec.Decode(&m)
+			got = append(got, &m)
+		case BlockType:
+			var m BlockType
+			err = dec.Decode(&m)
+			got = append(got, m)
+			btype = m
+		case *LocalBlock:
+			var m LocalBlock
+			err = dec.Decode(&m)
+			got = append(got, &m)
+		case *RemoteBlock:
+			var m RemoteBlock
+			err = dec.Decode(&m)
+			got = append(got, &m)
+		case []byte:
+			var m []byte
+			if btype == FileSum {
+				err = dec.Decode(&m)
+			} else {
+				m = make([]byte, len(y))
+				_, err = io.ReadFull(dec, m)
+			}
+			got = append(got, m)
+		case *Result:
+			var m Result
+			err = dec.Decode(&m)
+			got = append(got, &m)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if diff := cmp.Diff(in, got); diff != "" {
+		t.Errorf("binary round trip mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestBinaryDecodeTagMismatch(t *testing.T) {
+	var b bytes.Buffer
+	if err := newBinaryEncoder(&b).Encode(LocalBlock{Size: 1}); err != nil {
+		t.Fatal(err)
+	}
+	var rb RemoteBlock
+	if err := newBinaryDecoder(&b).Decode(&rb); err == nil {
+		t.Fatal("Decode(...) succeeded on a mismatching message")
+	}
+}
+
+func TestSendResultParts(t *testing.T) {
+	long := strings.Repeat("x", 4000)
+	var want Result
+	for i := 0; len(want.Created)*len(long) < 3*maxResultPart; i++ {
+		want.Created = append(want.Created, fmt.Sprintf("%s/%d", long, i))
+	}
+	want.Failed = []FileError{{Path: "dir", Code: CodePermission, Err: "permission denied"}}
+	var b bytes.Buffer
+	if err := SendResult(newBinaryEncoder(&b), &want); err != nil {
+		t.Fatal(err)
+	}
+	parts := bytes.NewReader(b.Bytes())
+	dec := newBinaryDecoder(parts)
+	var n int
+	for parts.Len() > 0 || dec.r.Buffered() > 0 {
+		var part Result
+		if err := dec.Decode(&part); err != nil {
+			t.Fatal(err)
+		}
+		n++
+	}
+	if n < 3 {
+		t.Errorf("result sent in %d part(s), want at least 3", n)
+	}
+	var got Result
+	if err := RecvResult(newBinaryDecoder(&b), &got); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("RecvResult(...) mismatch (-want +got):\n%s", diff)
+	}
+}
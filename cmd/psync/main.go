@@ -1,7 +1,8 @@
 package main
 
 import (
-	"encoding/gob"
+	"bufio"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -10,7 +11,10 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/cakturk/psync"
@@ -22,8 +26,146 @@ var (
 	proto          = flag.String("proto", "tcp4", "connection protocol defaults to tcp (tcp, unix)")
 	mon            = flag.Bool("mon", false, "monitor file system events")
 	allowEmptyDirs = flag.Bool("allowemptydirs", true, "syncronize empty directories")
+	compress       = flag.Bool("z", false, "compress file data during the transfer")
+	wireFormat     = flag.String("wireformat", "", "restrict the message encoding used on the wire (gob, binary)")
+	owner          = flag.Bool("o", false, "preserve owner (super-user only)")
+	group          = flag.Bool("g", false, "preserve group")
+	numericIDs     = flag.Bool("numeric-ids", false, "don't map uid/gid values by user/group name")
+	copyLinks      = flag.Bool("l", false, "copy symlinks as symlinks (they are skipped unless -l or -L is given)")
+	followLinks    = flag.Bool("L", false, "transform symlinks into referent files/dirs")
+	safeLinks      = flag.Bool("safe-links", false, "ignore symlinks that point outside the tree")
+	hardLinks      = flag.Bool("H", false, "preserve hard links")
+	checksum       = flag.Bool("c", false, "skip based on checksum, not mod-time & size")
+	dryRun         = flag.Bool("n", false, "perform a trial run with no changes made")
 )
 
+var wireFormats = map[string]byte{
+	"":       psync.WireFormatSet(psync.WireFormatGob, psync.WireFormatBinary),
+	"gob":    psync.WireFormatSet(psync.WireFormatGob),
+	"binary": psync.WireFormatSet(psync.WireFormatBinary),
+}
+
+var (
+	filterRules    []psync.Rule
+	protectRules   []psync.Rule
+	deleteExcluded = flag.Bool("delete-excluded", false, "also delete excluded files from the destination")
+	gitIgnore      = flag.Bool("gitignore", false, "read .gitignore files along with .psyncignore ones")
+	deleteDuring   = flag.Bool("delete-during", false, "receiver deletes extraneous files during the transfer")
+	deleteAfter    = flag.Bool("delete-after", false, "receiver deletes extraneous files after the transfer")
+	backup         = flag.Bool("b", false, "make backups of the files replaced or deleted on the destination")
+	backupSuffix   = flag.String("suffix", "", "backup `suffix` (default \""+psync.DefaultBackupSuffix+"\" w/o -backup-dir)")
+	backupDir      = flag.String("backup-dir", "", "make backups into `dir`, relative to the destination, implies -b")
+	backupTime     = flag.Bool("backup-timestamp", false, "make the backups of every sync into a timestamped subdirectory of -backup-dir")
+	tempDir        = flag.String("temp-dir", "", "create temporary files in `dir`ectory, relative to the destination")
+	delayUpdates   = flag.Bool("delay-updates", false, "put all updated files into place at end of transfer")
+	inplace        = flag.Bool("inplace", false, "update destination files in-place")
+	partial        = flag.Bool("partial", false, "keep partially transferred files to resume their transfer")
+	partialDir     = flag.String("partial-dir", "", "keep partially transferred files in `dir`, relative to the destination, implies -partial")
+	sparse         = flag.Bool("S", false, "turn sequences of nulls into sparse blocks")
+	xattrs         = flag.Bool("X", false, "preserve extended attributes")
+	acls           = flag.Bool("A", false, "preserve ACLs")
+	devices        = flag.Bool("devices", false, "preserve device files (super-user only)")
+	specials       = flag.Bool("specials", false, "preserve special files")
+	sizeOnly       = flag.Bool("size-only", false, "skip files that match in size")
+	ignoreTimes    = flag.Bool("I", false, "don't skip files that match size and time")
+	update         = flag.Bool("u", false, "skip files that are newer on the receiver")
+	ignoreExisting = flag.Bool("ignore-existing", false, "skip updating files that exist on receiver")
+	existing       = flag.Bool("existing", false, "skip creating new files on receiver")
+	modifyWindow   = flag.Int("modify-window", 0, "compare mod-times with reduced accuracy, `N` seconds apart at most")
+	oneFileSystem  = flag.Bool("x", false, "don't cross filesystem boundaries")
+	maxSize        int64
+	minSize        int64
+	maxDelete      = flag.Int("max-delete", 0, "don't delete any files if more than `N` would be deleted (0 means no limit)")
+)
+
+func init() {
+	flag.BoolVar(checksum, "checksum", false, "same as -c")
+	flag.BoolVar(backup, "backup", false, "same as -b")
+	flag.BoolVar(sparse, "sparse", false, "same as -S")
+	flag.BoolVar(xattrs, "xattrs", false, "same as -X")
+	flag.BoolVar(acls, "acls", false, "same as -A")
+	flag.Var(boolFlags{devices, specials}, "D", "same as -devices -specials")
+	flag.BoolVar(ignoreTimes, "ignore-times", false, "same as -I")
+	flag.BoolVar(update, "update", false, "same as -u")
+	flag.BoolVar(oneFileSystem, "one-file-system", false, "same as -x")
+	flag.Var(sizeFlag{&maxSize}, "max-size", "don't transfer any file larger than `SIZE` (K, M, G and T suffixes)")
+	flag.Var(sizeFlag{&minSize}, "min-size", "don't transfer any file smaller than `SIZE`")
+	flag.Var(ruleFlag{rules: &filterRules, include: false}, "exclude", "exclude files matching `pattern`")
+	flag.Var(ruleFlag{rules: &filterRules, include: true}, "include", "don't exclude files matching `pattern`")
+	flag.Var(ruleFileFlag{}, "exclude-from", "read exclude patterns from `file`")
+	flag.Var(ruleFlag{rules: &protectRules, include: false}, "protect", "never delete files matching `pattern` from the destination")
+}
+
+// ruleFlag appends the rules given on the command line to rules,
+// preserving the order of the include and exclude rules.
+type ruleFlag struct {
+	rules   *[]psync.Rule
+	include bool
+}
+
+func (ruleFlag) String() string { return "" }
+
+func (f ruleFlag) Set(s string) error {
+	*f.rules = append(*f.rules, psync.Rule{Include: f.include, Pattern: s})
+	return nil
+}
+
+// boolFlags sets all of its flags at once.
+type boolFlags []*bool
+
+func (boolFlags) String() string   { return "" }
+func (boolFlags) IsBoolFlag() bool { return true }
+
+func (f boolFlags) Set(s string) error {
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	for _, b := range f {
+		*b = v
+	}
+	return nil
+}
+
+// sizeFlag is a file size given in bytes, or in binary multiples of
+// them with the K, M, G and T suffixes.
+type sizeFlag struct{ size *int64 }
+
+func (sizeFlag) String() string { return "" }
+
+func (f sizeFlag) Set(s string) error {
+	num, mul := s, int64(1)
+	if n := len(s); n > 0 {
+		if i := strings.Index("KMGT", strings.ToUpper(s[n-1:])); i >= 0 {
+			num, mul = s[:n-1], 1<<(10*uint(i+1))
+		}
+	}
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil || v < 0 {
+		return fmt.Errorf("invalid size: %q", s)
+	}
+	*f.size = int64(v * float64(mul))
+	return nil
+}
+
+type ruleFileFlag struct{}
+
+func (ruleFileFlag) String() string { return "" }
+
+func (ruleFileFlag) Set(s string) error {
+	f, err := os.Open(s)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rules, err := psync.ReadRules(f)
+	if err != nil {
+		return err
+	}
+	filterRules = append(filterRules, rules...)
+	return nil
+}
+
 func main() {
 	flag.Parse()
 	log.SetOutput(ioutil.Discard)
@@ -35,6 +177,10 @@ func main() {
 	if flag.NArg() != 1 {
 		die(1, "invalid argument: %v", flag.Args())
 	}
+	wfs, ok := wireFormats[*wireFormat]
+	if !ok {
+		die(1, "unknown wire format: %s", *wireFormat)
+	}
 	c, err := net.DialTimeout(*proto, *addr, 200*time.Millisecond)
 	_ = c
 	if err != nil {
@@ -47,7 +193,95 @@ func main() {
 			die(1, "failed to create fs watcher: %v", err)
 		}
 	}
-	if err := run(c, flag.Arg(0), *allowEmptyDirs, watcher); err != nil {
+	opts := psync.Options{
+		Owner:    *owner,
+		Group:    *group,
+		Checksum: *checksum,
+		DryRun:   *dryRun,
+
+		Filter:         filterRules,
+		DeleteExcluded: *deleteExcluded,
+		MaxDelete:      *maxDelete,
+		Protect:        protectRules,
+
+		Backup:          *backup || *backupDir != "",
+		BackupSuffix:    *backupSuffix,
+		BackupDir:       *backupDir,
+		BackupTimestamp: *backupTime,
+
+		TempDir:      *tempDir,
+		DelayUpdates: *delayUpdates,
+		Inplace:      *inplace,
+
+		Partial:    *partial || *partialDir != "",
+		PartialDir: *partialDir,
+		Sparse:     *sparse,
+
+		Xattrs: *xattrs,
+		ACLs:   *acls,
+
+		Devices:  *devices,
+		Specials: *specials,
+
+		SizeOnly:       *sizeOnly,
+		IgnoreTimes:    *ignoreTimes,
+		Update:         *update,
+		IgnoreExisting: *ignoreExisting,
+		Existing:       *existing,
+		ModifyWindow:   time.Duration(*modifyWindow) * time.Second,
+	}
+	if opts.Inplace && opts.DelayUpdates {
+		die(1, "-inplace and -delay-updates are mutually exclusive")
+	}
+	if *modifyWindow < 0 {
+		die(1, "invalid -modify-window: %d", *modifyWindow)
+	}
+	if *backupTime && *backupDir == "" {
+		die(1, "-backup-timestamp requires -backup-dir")
+	}
+	switch {
+	case *deleteDuring && *deleteAfter:
+		die(1, "-delete-during and -delete-after are mutually exclusive")
+	case *deleteDuring:
+		opts.Delete = psync.DeleteDuring
+	case *deleteAfter:
+		opts.Delete = psync.DeleteAfter
+	}
+	filter, err := psync.NewFilter(filterRules)
+	if err != nil {
+		die(1, "%v", err)
+	}
+	if _, err := psync.NewFilter(protectRules); err != nil {
+		die(1, "%v", err)
+	}
+	lis := psync.SrcFileLister{
+		Root:             flag.Arg(0),
+		IncludeEmptyDirs: *allowEmptyDirs,
+		LookupNames:      (opts.Owner || opts.Group) && !*numericIDs,
+		SafeLinks:        *safeLinks,
+		HardLinks:        *hardLinks,
+		Filter:           filter,
+		GitIgnore:        *gitIgnore,
+		Xattrs:           opts.Xattrs,
+		ACLs:             opts.ACLs,
+		Devices:          opts.Devices,
+		Specials:         opts.Specials,
+		MaxSize:          maxSize,
+		MinSize:          minSize,
+		OneFileSystem:    *oneFileSystem,
+	}
+	opts.IgnoreFiles = lis.IgnoreFiles()
+	switch {
+	case *copyLinks && *followLinks:
+		die(1, "-l and -L are mutually exclusive")
+	case *copyLinks:
+		lis.Links = psync.SymlinkCopy
+	case *followLinks:
+		lis.Links = psync.SymlinkFollow
+	default:
+		lis.Links = psync.SymlinkSkip
+	}
+	if err := run(c, &lis, &opts, *compress, wfs, watcher); err != nil {
 		c.Close()
 		die(2, "%v", err)
 	}
@@ -61,42 +295,91 @@ func main() {
 // send block descriptors
 // ? receive some kind of exit code, which indicates wheter
 // the receiver was successful or not.
-func run(conn net.Conn, root string, allowEmptyDirs bool, watcher *fsnotify.Watcher) error {
+func run(conn net.Conn, lis *psync.SrcFileLister, opts *psync.Options, compress bool, wireFormats byte, watcher *fsnotify.Watcher) error {
 	defer conn.Close()
-	hs := psync.NewHandshake(1, psync.WireFormatGob, 0)
+	var flags byte
+	if compress {
+		flags |= psync.CompressGzip
+	}
+	hs := psync.NewHandshake(psync.ProtoVersion, wireFormats, flags)
+	hs.MinVersion = psync.MinProtoVersion
 	_, err := hs.WriteTo(conn)
 	if err != nil {
 		return err
 	}
-	lis := psync.SrcFileLister{
-		Root:             root,
-		IncludeEmptyDirs: allowEmptyDirs,
+	rh, err := psync.ReadHandshake(conn)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF || errors.Is(err, syscall.ECONNRESET) {
+			return fmt.Errorf(
+				"server closed the connection during the handshake, it probably does not speak protocol version %d-%d",
+				psync.MinProtoVersion, psync.ProtoVersion,
+			)
+		}
+		return fmt.Errorf("failed to handshake: %w", err)
+	}
+	a, err := psync.Negotiate(hs, &rh)
+	if err != nil {
+		return fmt.Errorf("failed to handshake: %w", err)
 	}
+	if compress && a.Flags&psync.CompressGzip == 0 {
+		fmt.Fprintln(os.Stderr, "psync: server does not support compression, continuing without it")
+	}
+	root := lis.Root
 	s, err := lis.List()
 	if err != nil {
 		return err
 	}
-	enc := gob.NewEncoder(conn)
-	dec := gob.NewDecoder(conn)
+	cc := &countConn{Conn: conn}
+	var (
+		w psync.WriteFlusher = bufio.NewWriter(cc)
+		r io.Reader          = cc
+	)
+	if a.Flags&psync.CompressGzip != 0 {
+		w = psync.NewCompressWriter(cc)
+		r = psync.NewCompressReader(cc)
+	}
+	enc, err := psync.NewEncoder(w, a.WireFormat)
+	if err != nil {
+		return err
+	}
+	dec, err := psync.NewDecoder(r, a.WireFormat)
+	if err != nil {
+		return err
+	}
+	// options are flushed on their own, so that they are not counted
+	// in the size of the first file list
+	if err = enc.Encode(opts); err != nil {
+		return fmt.Errorf("sending options failed: %w", err)
+	}
+	if err = w.Flush(); err != nil {
+		return fmt.Errorf("sending options failed: %w", err)
+	}
 	cli := client{
 		sender: psync.Sender{
-			Enc: encWriter{
-				Writer:  conn,
-				Encoder: enc,
-			},
-			Root: root,
+			Enc:     enc,
+			Root:    root,
+			Inplace: opts.Inplace,
 		},
-		enc: enc,
-		dec: dec,
+		conn:   cc,
+		w:      w,
+		enc:    enc,
+		dec:    dec,
+		dryRun: opts.DryRun,
 	}
 	if err = cli.sync(s, true); err != nil {
-		return err
+		// while monitoring, the files failed to sync are retried
+		// on their next change, the same as after the later syncs
+		var ferr failedError
+		if watcher == nil || !errors.As(err, &ferr) {
+			return err
+		}
+		log.Printf("sync error (will retry): %v", err)
 	}
 	if watcher == nil {
 		return nil
 	}
 	defer watcher.Close()
-	if err = watchDir(watcher, root); err != nil {
+	if err = watchDir(watcher, root, lis); err != nil {
 		return err
 	}
 
@@ -115,6 +398,20 @@ func run(conn net.Conn, root string, allowEmptyDirs bool, watcher *fsnotify.Watc
 				return nil
 			}
 
+			// Changing an ignore file may include or exclude any
+			// file below it, so rescan the whole tree.
+			if lis.IsIgnoreFile(event.Name) {
+				hasRemove = true
+				eventBatch[event.Name] = event.Op
+				continue
+			}
+			// Ignored paths must not trigger a sync
+			if ex, err := lis.Excluded(event.Name); err != nil {
+				log.Printf("filter error for %s: %v", event.Name, err)
+			} else if ex {
+				continue
+			}
+
 			// Accumulate events in batch
 			// For the same path, keep the latest operation
 			// Rename events come as Remove + Create
@@ -145,7 +442,7 @@ func run(conn net.Conn, root string, allowEmptyDirs bool, watcher *fsnotify.Watc
 			// If we had remove events, do a full sync to handle deletions properly
 			// This is more efficient than scanning on every individual delete
 			if hasRemove {
-				if err := processFullSync(&cli, &lis); err != nil {
+				if err := processFullSync(&cli, lis); err != nil {
 					log.Printf("sync error (will retry): %v", err)
 					// Don't terminate on sync errors, just log and continue
 				}
@@ -159,7 +456,7 @@ func run(conn net.Conn, root string, allowEmptyDirs bool, watcher *fsnotify.Watc
 			for path, op := range eventBatch {
 				if op == fsnotify.Create {
 					// Handle directory creation - add watches
-					if err := watchDirIfExists(watcher, path, &lis, &filesToSync); err != nil {
+					if err := watchDirIfExists(watcher, path, lis, &filesToSync); err != nil {
 						log.Printf("watch error for %s: %v", path, err)
 						// Continue processing other files
 					}
@@ -236,6 +533,9 @@ func watchDirIfExists(watcher *fsnotify.Watcher, path string, lis *psync.SrcFile
 				}
 				return nil // Continue on other errors
 			}
+			if walkPath != path && skipWatch(lis, walkPath, fi) {
+				return filepath.SkipDir
+			}
 
 			// Add to file list
 			sl, err := lis.AddSrcFile(*files, walkPath)
@@ -260,11 +560,27 @@ func watchDirIfExists(watcher *fsnotify.Watcher, path string, lis *psync.SrcFile
 	return nil
 }
 
+// failedError is returned by sync if the receiver has failed to sync
+// some of the files. Unlike after any other error, the session can go
+// on after it.
+type failedError struct{ error }
+
+// resultErr returns the error summarizing the failed files of res.
+func resultErr(res *psync.Result) error {
+	if err := res.Err(); err != nil {
+		return failedError{err}
+	}
+	return nil
+}
+
 type client struct {
 	mu     sync.Mutex
 	sender psync.Sender
+	conn   *countConn
+	w      psync.WriteFlusher
 	enc    psync.Encoder
 	dec    psync.Decoder
+	dryRun bool
 }
 
 func (c *client) sync(list []psync.SenderSrcFile, delete bool) error {
@@ -272,29 +588,156 @@ func (c *client) sync(list []psync.SenderSrcFile, delete bool) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	sent, received := c.conn.sent, c.conn.received
 	err := psync.SendSrcFileList(c.enc, list, delete)
 	if err != nil {
 		return err
 	}
+	if err = c.w.Flush(); err != nil {
+		return err
+	}
+	fileListSize := c.conn.sent - sent
 	// conn.SetReadDeadline(time.Now().Add(2 * time.Second))
 	n, err := psync.RecvDstFileList(c.dec, list)
 	if err != nil {
 		return err
 	}
+	if c.dryRun {
+		return c.dryRunResult(list)
+	}
+	if err := c.sender.SendSumMatches(list); err != nil {
+		return err
+	}
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	if err := psync.RecvMismatchChunks(c.dec, list); err != nil {
+		return err
+	}
+	checksumSize := c.conn.received - received
+	items, err := c.sender.Itemize(list)
+	if err != nil {
+		return err
+	}
+	c.sender.Stats = psync.Stats{}
 	if n == 0 {
 		log.Println("nothing has been changed")
-		return nil
+	} else {
+		log.Printf("%d file(s) seems to have changed", n)
+		err = c.sender.SendBlockDescList(list)
+		if ferr := c.w.Flush(); err == nil {
+			err = ferr
+		}
+		if err != nil {
+			// the receiver is still waiting for the rest of the
+			// block stream, there is no result to wait for.
+			return err
+		}
+	}
+	var res psync.Result
+	if err := psync.RecvResult(c.dec, &res); err != nil {
+		return fmt.Errorf("failed to recv sync result: %w", err)
+	}
+	failed := make(map[string]bool)
+	for _, f := range res.Failed {
+		fmt.Fprintf(os.Stderr, "psync: %s: %s\n", f.Path, f.Err)
+		failed[f.Path] = true
+	}
+	st := c.sender.Stats
+	for _, p := range res.Deleted {
+		items = append(items, psync.Item{Path: p, Action: psync.ActionDelete})
+	}
+	for _, it := range items {
+		if it.Action == psync.ActionNone || failed[it.Path] {
+			continue
+		}
+		if it.Action != psync.ActionSkip {
+			st.NumChanged++
+		}
+		fmt.Println(it.String())
+	}
+	st.NumFiles = len(list)
+	for i := range list {
+		if list[i].Mode.IsRegular() {
+			st.TotalSize += list[i].Size
+		}
 	}
-	log.Printf("%d file(s) seems to have changed", n)
-	err = c.sender.SendBlockDescList(list)
-	// time.Sleep(1 * time.Second)
-	var ack uint32
-	if err := c.dec.Decode(&ack); err != nil {
-		fmt.Printf("failed to recv ack\n")
+	st.FileListSize = fileListSize
+	st.ChecksumSize = checksumSize
+	st.Sent = c.conn.sent - sent
+	st.Received = c.conn.received - received
+	fmt.Println()
+	st.WriteTo(os.Stdout)
+	fmt.Printf(
+		"%d created, %d updated, %d deleted, %d failed\n",
+		len(res.Created), len(res.Updated), len(res.Deleted), len(res.Failed),
+	)
+	return resultErr(&res)
+}
+
+// countConn counts the bytes sent and received on a connection.
+type countConn struct {
+	net.Conn
+	sent, received int64
+}
+
+func (c *countConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.received += int64(n)
+	return n, err
+}
+
+func (c *countConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.sent += int64(n)
+	return n, err
+}
+
+var actionNames = map[psync.Action]string{
+	psync.ActionCreate: "create",
+	psync.ActionUpdate: "delta-update",
+	psync.ActionAttrs:  "metadata-only",
+	psync.ActionDelete: "delete",
+	psync.ActionSkip:   "skip",
+}
+
+// dryRunResult prints what the receiver would do with the files in
+// list, along with the deletions it reports.
+func (c *client) dryRunResult(list []psync.SenderSrcFile) error {
+	items, err := c.sender.Itemize(list)
+	if err != nil {
 		return err
 	}
-	fmt.Printf("recv'd ack: %x\n", ack)
-	return err
+	var res psync.Result
+	if err := psync.RecvResult(c.dec, &res); err != nil {
+		return fmt.Errorf("failed to recv sync result: %w", err)
+	}
+	for _, f := range res.Failed {
+		fmt.Fprintf(os.Stderr, "psync: %s: %s\n", f.Path, f.Err)
+	}
+	for _, p := range res.Deleted {
+		items = append(items, psync.Item{Path: p, Action: psync.ActionDelete})
+	}
+	counts := make(map[psync.Action]int)
+	for _, it := range items {
+		if it.Action == psync.ActionNone {
+			continue
+		}
+		counts[it.Action]++
+		path := it.Path
+		if it.Mode.IsDir() {
+			path += "/"
+		}
+		fmt.Printf("%-13s %s\n", actionNames[it.Action], path)
+	}
+	fmt.Printf(
+		"%d created, %d updated, %d deleted, %d failed (dry run)\n",
+		counts[psync.ActionCreate],
+		counts[psync.ActionUpdate]+counts[psync.ActionAttrs],
+		counts[psync.ActionDelete],
+		len(res.Failed),
+	)
+	return resultErr(&res)
 }
 
 func die(code int, format string, a ...interface{}) {
@@ -302,12 +745,7 @@ func die(code int, format string, a ...interface{}) {
 	os.Exit(code)
 }
 
-type encWriter struct {
-	io.Writer
-	psync.Encoder
-}
-
-func watchDirFn(watcher *fsnotify.Watcher, root string, fn func(path string)) error {
+func watchDirFn(watcher *fsnotify.Watcher, root string, lis *psync.SrcFileLister, fn func(path string)) error {
 	err := filepath.Walk(root, func(walkPath string, fi os.FileInfo, err error) error {
 		if err != nil {
 			// Handle errors during walk gracefully
@@ -316,6 +754,9 @@ func watchDirFn(watcher *fsnotify.Watcher, root string, fn func(path string)) er
 			}
 			return nil // Continue on other errors
 		}
+		if walkPath != root && skipWatch(lis, walkPath, fi) {
+			return filepath.SkipDir
+		}
 		if fn != nil {
 			fn(walkPath)
 		}
@@ -330,6 +771,20 @@ func watchDirFn(watcher *fsnotify.Watcher, root string, fn func(path string)) er
 	return err
 }
 
-func watchDir(watcher *fsnotify.Watcher, root string) error {
-	return watchDirFn(watcher, root, nil)
+func watchDir(watcher *fsnotify.Watcher, root string, lis *psync.SrcFileLister) error {
+	return watchDirFn(watcher, root, lis, nil)
+}
+
+// skipWatch reports whether the directory at path is excluded, so that
+// neither it nor anything below it is watched.
+func skipWatch(lis *psync.SrcFileLister, path string, fi os.FileInfo) bool {
+	if !fi.IsDir() {
+		return false
+	}
+	ex, err := lis.Excluded(path)
+	if err != nil {
+		log.Printf("filter error for %s: %v", path, err)
+		return false
+	}
+	return ex
 }
@@ -19,8 +19,7 @@ var (
 	proto      = flag.String("proto", "tcp4", "listen protocol defaults to tcp (tcp, unix)")
 	blocksize  = flag.Int("blocksize", 8, "block size")
 
-	handshakeReadDeadline        = 300 * time.Millisecond
-	protoVersion          uint16 = 1
+	handshakeReadDeadline = 300 * time.Millisecond
 )
 
 func main() {
@@ -46,6 +45,12 @@ func main() {
 
 func run(l net.Listener, root string, blockSize int) error {
 	defer l.Close()
+	hs := psync.NewHandshake(
+		psync.ProtoVersion,
+		psync.WireFormatSet(psync.WireFormatGob, psync.WireFormatBinary),
+		psync.CompressGzip,
+	)
+	hs.MinVersion = psync.MinProtoVersion
 	for {
 		c, err := l.Accept()
 		if err != nil {
@@ -65,25 +70,54 @@ func run(l net.Listener, root string, blockSize int) error {
 			c.Close()
 			continue
 		}
-		if h.Version != protoVersion {
-			log.Print("protocol version mismatch")
+		// Reply with our own capabilities even if there is nothing
+		// in common, so that the client can tell what went wrong.
+		if _, err := hs.WriteTo(c); err != nil {
+			log.Printf("failed to handshake: %v", err)
+			c.Close()
+			continue
+		}
+		a, err := psync.Negotiate(hs, &h)
+		if err != nil {
+			log.Printf("failed to handshake: %v", err)
+			c.Close()
+			continue
+		}
+		var (
+			w psync.WriteFlusher = bufio.NewWriter(c)
+			r io.Reader          = c
+		)
+		if a.Flags&psync.CompressGzip != 0 {
+			w = psync.NewCompressWriter(c)
+			r = psync.NewCompressReader(c)
+		}
+		enc, err := psync.NewEncoder(w, a.WireFormat)
+		if err != nil {
+			log.Print(err)
+			c.Close()
+			continue
+		}
+		dec, err := psync.NewDecoder(r, a.WireFormat)
+		if err != nil {
+			log.Print(err)
+			c.Close()
+			continue
+		}
+		var opts psync.Options
+		if err := dec.Decode(&opts); err != nil {
+			log.Printf("failed to recv options: %v", err)
 			c.Close()
 			continue
 		}
-		br := bufio.NewReader(c)
-		dec := gob.NewDecoder(br)
-		enc := gob.NewEncoder(c)
 		s := session{
 			rcv: psync.Receiver{
 				Root: root,
-				Dec: decReader{
-					Reader:  br,
-					Decoder: dec,
-				},
+				Dec:  dec,
+				Opts: opts,
 			},
+			w:         w,
 			enc:       enc,
 			dec:       dec,
-			root:      root,
 			blocksize: blockSize,
 		}
 		if err := s.syncLoop(); err != nil {
@@ -95,9 +129,9 @@ func run(l net.Listener, root string, blockSize int) error {
 
 type session struct {
 	rcv       psync.Receiver
+	w         psync.WriteFlusher
 	enc       psync.Encoder
 	dec       psync.Decoder
-	root      string
 	blocksize int
 }
 
@@ -107,31 +141,69 @@ func (c *session) syncLoop() error {
 		if err != nil {
 			return fmt.Errorf("src file list: %w", err)
 		}
-		// First remove extraneous files
-		if delete {
-			if err := psync.DeleteExtra(rs, c.root); err != nil {
-				return err
-			}
+		var res psync.Result
+		c.rcv.SyncTime = time.Now()
+		timing := c.rcv.Opts.Delete
+		// First remove extraneous files. A failure to do so is
+		// sent back in the result like any other, once the sender
+		// is done with the file lists.
+		var delErr error
+		if delete && timing == psync.DeleteBefore {
+			delErr = c.rcv.DeleteExtra(rs, &res)
 		}
 		// TODO: this feels a little tricky. so find a better
 		// way to sync empty directories.
-		if err := psync.MkDirs(rs, c.root); err != nil {
+		if err := c.rcv.MkDirs(rs, &res); err != nil {
 			return err
 		}
-		n, err := psync.SendDstFileList(c.root, c.blocksize, rs, c.enc)
+		n, err := c.rcv.SendDstFileList(c.blocksize, rs, c.enc)
 		if err != nil {
 			return fmt.Errorf("send dst: %w", err)
 		}
-		if n == 0 {
+		if err := c.w.Flush(); err != nil {
+			return err
+		}
+		// the sender computes the deltas in the meantime
+		if delErr == nil && delete && timing == psync.DeleteDuring {
+			delErr = c.rcv.DeleteExtra(rs, &res)
+		}
+		if !c.rcv.Opts.DryRun {
+			if err := c.rcv.SendMismatchChunks(rs, c.enc); err != nil {
+				return fmt.Errorf("send dst: %w", err)
+			}
+			if err := c.w.Flush(); err != nil {
+				return err
+			}
+		}
+		err = delErr
+		if c.rcv.Opts.DryRun {
+			log.Printf("dry run: %d file(s) would be transferred", n)
+		} else if n == 0 {
 			log.Println("nothing has been changed")
-			continue
+		} else if err == nil {
+			log.Printf("%d file(s) seems to have changed", n)
+			err = c.rcv.BuildFiles(n, rs, &res)
+		}
+		if err == nil {
+			err = c.rcv.MkLinks(rs, &res)
 		}
-		log.Printf("%d file(s) seems to have changed", n)
-		err = c.rcv.BuildFiles(n, rs)
-		// if err != nil {
-		// 	return fmt.Errorf("build: %w", err)
-		// }
-		if err := c.enc.Encode(uint32(0x1a2b)); err != nil {
+		if err == nil && delete && timing == psync.DeleteAfter {
+			err = c.rcv.DeleteExtra(rs, &res)
+		}
+		if err == nil {
+			err = c.rcv.FinishAttrs(rs, &res)
+		}
+		// Send the result even if the build has failed, the block
+		// stream is out of sync after such a failure though, so
+		// the session cannot go on.
+		if err := psync.SendResult(c.enc, &res); err != nil {
+			return fmt.Errorf("send result: %w", err)
+		}
+		if err := c.w.Flush(); err != nil {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("build: %w", err)
 		}
 	}
 }
@@ -141,11 +213,6 @@ func die(code int, format string, a ...interface{}) {
 	os.Exit(code)
 }
 
-type decReader struct {
-	io.Reader
-	psync.Decoder
-}
-
 type debugEncoder struct {
 	s []interface{}
 	e *gob.Encoder
@@ -0,0 +1,65 @@
+package psync
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+)
+
+// WriteFlusher is an io.Writer that buffers data internally. Flush must
+// be called whenever the peer is expected to act on what has been
+// written so far, otherwise both sides may end up waiting for each
+// other.
+type WriteFlusher interface {
+	io.Writer
+	Flush() error
+}
+
+type compressWriter struct {
+	zw *gzip.Writer
+	bw *bufio.Writer
+}
+
+// NewCompressWriter returns a WriteFlusher that gzip compresses
+// everything written to it before passing it on to w. The compressed
+// stream is never closed, Flush only emits a sync marker so that the
+// reader can decode everything written so far.
+func NewCompressWriter(w io.Writer) WriteFlusher {
+	bw := bufio.NewWriter(w)
+	return &compressWriter{
+		zw: gzip.NewWriter(bw),
+		bw: bw,
+	}
+}
+
+func (c *compressWriter) Write(p []byte) (int, error) { return c.zw.Write(p) }
+
+func (c *compressWriter) Flush() error {
+	if err := c.zw.Flush(); err != nil {
+		return err
+	}
+	return c.bw.Flush()
+}
+
+type compressReader struct {
+	r  io.Reader
+	zr *gzip.Reader
+}
+
+// NewCompressReader returns a reader that decompresses the stream
+// written by a compressWriter. The gzip header is not read until the
+// first call to Read, as the peer may not have sent anything yet.
+func NewCompressReader(r io.Reader) io.Reader {
+	return &compressReader{r: r}
+}
+
+func (c *compressReader) Read(p []byte) (int, error) {
+	if c.zr == nil {
+		zr, err := gzip.NewReader(c.r)
+		if err != nil {
+			return 0, err
+		}
+		c.zr = zr
+	}
+	return c.zr.Read(p)
+}
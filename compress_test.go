@@ -0,0 +1,49 @@
+package psync
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	var conn bytes.Buffer
+	w := NewCompressWriter(&conn)
+	r := bufio.NewReader(NewCompressReader(&conn))
+	enc := gob.NewEncoder(w)
+	dec := gob.NewDecoder(r)
+	msgs := []FileDesc{
+		{ID: 1, Typ: NewFile, TotalSize: int64(len(orig))},
+		{ID: 2, Typ: PartialFile},
+	}
+	for _, m := range msgs {
+		if err := enc.Encode(m); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.Copy(w, strings.NewReader(orig)); err != nil {
+			t.Fatal(err)
+		}
+		// Nothing is guaranteed to reach the reader until the
+		// writer is flushed.
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		var got FileDesc
+		if err := dec.Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got != m {
+			t.Fatalf("Decode(...) = %#v, want %#v", got, m)
+		}
+		buf := make([]byte, len(orig))
+		if _, err := io.ReadFull(r, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != orig {
+			t.Fatalf("ReadFull(...) = %q, want %q", buf, orig)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package psync
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// Rule is a single include or exclude pattern. Patterns use the syntax
+// of path.Match, and are matched as follows:
+//
+//   - a pattern starting with a slash is anchored to the root directory,
+//     otherwise it matches the trailing components of a path at any
+//     depth, e.g. "b/c" matches "a/b/c" as well as "b/c",
+//   - a pattern ending with a slash only matches directories,
+//   - a "**" component matches zero or more path components.
+type Rule struct {
+	Include bool
+	Pattern string
+}
+
+func (r Rule) String() string {
+	if r.Include {
+		return "+ " + r.Pattern
+	}
+	return "- " + r.Pattern
+}
+
+// ParseRule parses a rule in the "+ pattern" or "- pattern" form. Lines
+// without a prefix are exclude rules.
+func ParseRule(s string) Rule {
+	switch {
+	case strings.HasPrefix(s, "+ "):
+		return Rule{Include: true, Pattern: s[2:]}
+	case strings.HasPrefix(s, "- "):
+		return Rule{Pattern: s[2:]}
+	}
+	return Rule{Pattern: s}
+}
+
+// ReadRules reads rules from r, one per line. Empty lines and the lines
+// starting with '#' or ';' are ignored.
+func ReadRules(r io.Reader) ([]Rule, error) {
+	var rules []Rule
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimRight(s.Text(), "\r")
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		rules = append(rules, ParseRule(line))
+	}
+	return rules, s.Err()
+}
+
+type filterRule struct {
+	include  bool
+	anchored bool
+	dirOnly  bool
+	elems    []string
+}
+
+// Filter decides which paths are excluded by an ordered list of rules.
+// The first rule matching a path wins, the paths no rule matches are
+// included. A nil Filter includes everything.
+type Filter struct {
+	rules []filterRule
+}
+
+// NewFilter compiles rules into a Filter.
+func NewFilter(rules []Rule) (*Filter, error) {
+	f := new(Filter)
+	for _, r := range rules {
+		if err := f.add(r); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (f *Filter) add(r Rule) error {
+	p := r.Pattern
+	fr := filterRule{include: r.Include}
+	if strings.HasPrefix(p, "/") {
+		fr.anchored = true
+		p = strings.TrimLeft(p, "/")
+	}
+	if strings.HasSuffix(p, "/") {
+		fr.dirOnly = true
+		p = strings.TrimRight(p, "/")
+	}
+	if p == "" {
+		return fmt.Errorf("invalid filter rule: %q", r.Pattern)
+	}
+	fr.elems = strings.Split(p, "/")
+	for _, e := range fr.elems {
+		if _, err := path.Match(e, ""); err != nil {
+			return fmt.Errorf("invalid filter rule %q: %w", r.Pattern, err)
+		}
+	}
+	f.rules = append(f.rules, fr)
+	return nil
+}
+
+// Excluded reports whether the file at name, a slash separated path
+// relative to the root directory, is excluded.
+func (f *Filter) Excluded(name string, isDir bool) bool {
+	excluded, _ := f.match(name, isDir)
+	return excluded
+}
+
+// match is like Excluded, ok is false if none of the rules matches
+// name.
+func (f *Filter) match(name string, isDir bool) (excluded, ok bool) {
+	if f == nil {
+		return false, false
+	}
+	elems := strings.Split(name, "/")
+	for i := range f.rules {
+		r := &f.rules[i]
+		if r.dirOnly && !isDir {
+			continue
+		}
+		if r.match(elems) {
+			return !r.include, true
+		}
+	}
+	return false, false
+}
+
+func (r *filterRule) match(elems []string) bool {
+	if r.anchored {
+		return matchElems(r.elems, elems)
+	}
+	for i := range elems {
+		if matchElems(r.elems, elems[i:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchElems(pattern, elems []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(elems); i++ {
+				if matchElems(pattern[1:], elems[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(elems) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], elems[0]); !ok {
+			return false
+		}
+		pattern, elems = pattern[1:], elems[1:]
+	}
+	return len(elems) == 0
+}
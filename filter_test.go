@@ -0,0 +1,67 @@
+package psync
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFilterExcluded(t *testing.T) {
+	tests := []struct {
+		rules []Rule
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{nil, "a/b", false, false},
+		{[]Rule{{Pattern: "*.o"}}, "x.o", false, true},
+		{[]Rule{{Pattern: "*.o"}}, "a/b/x.o", false, true},
+		{[]Rule{{Pattern: "*.o"}}, "a/x.c", false, false},
+		{[]Rule{{Pattern: "/x.o"}}, "x.o", false, true},
+		{[]Rule{{Pattern: "/x.o"}}, "a/x.o", false, false},
+		{[]Rule{{Pattern: "b/c"}}, "a/b/c", false, true},
+		{[]Rule{{Pattern: "b/c"}}, "a/bb/c", false, false},
+		{[]Rule{{Pattern: "build/"}}, "a/build", true, true},
+		{[]Rule{{Pattern: "build/"}}, "a/build", false, false},
+		{[]Rule{{Pattern: "/a/**/z"}}, "a/z", false, true},
+		{[]Rule{{Pattern: "/a/**/z"}}, "a/b/c/z", false, true},
+		{[]Rule{{Pattern: "/a/**/z"}}, "b/a/c/z", false, false},
+		{[]Rule{{Pattern: "src/**"}}, "x/src/y/z", false, true},
+		{[]Rule{{Include: true, Pattern: "keep.o"}, {Pattern: "*.o"}}, "keep.o", false, false},
+		{[]Rule{{Pattern: "*.o"}, {Include: true, Pattern: "keep.o"}}, "keep.o", false, true},
+	}
+	for _, tt := range tests {
+		f, err := NewFilter(tt.rules)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := f.Excluded(tt.path, tt.isDir); got != tt.want {
+			t.Errorf("%v: Excluded(%q, %v) = %v, want %v", tt.rules, tt.path, tt.isDir, got, tt.want)
+		}
+	}
+}
+
+func TestNewFilterInvalid(t *testing.T) {
+	for _, p := range []string{"/", "[a"} {
+		if _, err := NewFilter([]Rule{{Pattern: p}}); err == nil {
+			t.Errorf("NewFilter(%q) succeeded", p)
+		}
+	}
+}
+
+func TestReadRules(t *testing.T) {
+	in := "# comment\n\n*.o\n+ keep/\n- /tmp\n; another comment\n"
+	got, err := ReadRules(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Rule{
+		{Pattern: "*.o"},
+		{Include: true, Pattern: "keep/"},
+		{Pattern: "/tmp"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ReadRules(...) mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -6,5 +6,5 @@ require (
 	github.com/chmduquesne/rollinghash v4.0.0+incompatible
 	github.com/fsnotify/fsnotify v1.4.9
 	github.com/google/go-cmp v0.5.4
-	golang.org/x/sys v0.0.0-20210124154548-22da62e12c0c // indirect
+	golang.org/x/sys v0.0.0-20210124154548-22da62e12c0c
 )
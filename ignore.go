@@ -0,0 +1,196 @@
+package psync
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// IgnoreFile is the name of the files listing the paths to be left out
+// of the directory they are in, and of everything below it. They use
+// the syntax and semantics of .gitignore files:
+//
+//   - a pattern starting with '!' includes the paths excluded by the
+//     previous patterns again,
+//   - a pattern ending with a slash only matches directories,
+//   - a pattern with a slash at the beginning or in the middle is
+//     relative to the directory of the ignore file, otherwise it matches
+//     at any depth below it,
+//   - the last matching pattern of a file wins, and the files in deeper
+//     directories take precedence over the ones in their parents.
+const IgnoreFile = ".psyncignore"
+
+// GitIgnoreFile is read along with IgnoreFile on request. The rules of
+// IgnoreFile take precedence over the ones of GitIgnoreFile in the same
+// directory.
+const GitIgnoreFile = ".gitignore"
+
+// ReadIgnore reads the rules of an ignore file. Empty lines and the
+// lines starting with '#' are ignored, a backslash escapes a leading
+// '#' or '!', as well as trailing spaces.
+func ReadIgnore(r io.Reader) ([]Rule, error) {
+	var rules []Rule
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := trimTrailingSpace(strings.TrimRight(s.Text(), "\r"))
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		r := Rule{Pattern: line}
+		if line[0] == '!' {
+			r = Rule{Include: true, Pattern: line[1:]}
+		}
+		rules = append(rules, r)
+	}
+	return rules, s.Err()
+}
+
+func trimTrailingSpace(s string) string {
+	for strings.HasSuffix(s, " ") && !strings.HasSuffix(s, `\ `) {
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+// compileIgnore compiles the rules of an ignore file. Unlike the rules
+// of a Filter, a slash anywhere but at the end anchors a pattern.
+func compileIgnore(rules []Rule) ([]filterRule, error) {
+	var frs []filterRule
+	for _, r := range rules {
+		p := r.Pattern
+		fr := filterRule{include: r.Include}
+		if strings.HasSuffix(p, "/") {
+			fr.dirOnly = true
+			p = strings.TrimRight(p, "/")
+		}
+		if strings.Contains(p, "/") {
+			fr.anchored = true
+			p = strings.TrimLeft(p, "/")
+		}
+		if p == "" {
+			// git ignores the patterns matching nothing
+			continue
+		}
+		fr.elems = strings.Split(p, "/")
+		// a trailing "**" matches everything inside a directory but
+		// not the directory itself
+		if n := len(fr.elems); n > 1 && fr.elems[n-1] == "**" {
+			fr.elems = append(fr.elems[:n-1], "*", "**")
+		}
+		for _, e := range fr.elems {
+			if _, err := path.Match(e, ""); err != nil {
+				return nil, fmt.Errorf("invalid ignore rule %q: %w", r.Pattern, err)
+			}
+		}
+		frs = append(frs, fr)
+	}
+	return frs, nil
+}
+
+// ignoreRules holds the rules of the ignore files of a tree. They are
+// read as the paths below their directories are matched, and kept for
+// the later matches.
+type ignoreRules struct {
+	root  string
+	names []string
+
+	// rules of the ignore files keyed by the slash separated path of
+	// their directory relative to the root.
+	dirs map[string][]filterRule
+}
+
+func newIgnoreRules(root string, names []string) *ignoreRules {
+	return &ignoreRules{
+		root:  root,
+		names: names,
+		dirs:  make(map[string][]filterRule),
+	}
+}
+
+// match reports whether the ignore files exclude name, a slash
+// separated path relative to the root, or include it again. Only the
+// ignore files of the parent directories of name are consulted, so the
+// ones of a directory excluded by its parents are not. ok is false if
+// no rule matches name.
+func (ig *ignoreRules) match(name string, isDir bool) (excluded, ok bool, err error) {
+	if ig == nil || len(ig.names) == 0 {
+		return false, false, nil
+	}
+	elems := strings.Split(name, "/")
+	for i := len(elems) - 1; i >= 0; i-- {
+		dir := path.Join(elems[:i]...)
+		if dir == "" {
+			dir = "."
+		}
+		rules, err := ig.load(dir)
+		if err != nil {
+			return false, false, err
+		}
+		for j := len(rules) - 1; j >= 0; j-- {
+			r := &rules[j]
+			if r.dirOnly && !isDir {
+				continue
+			}
+			if r.match(elems[i:]) {
+				return !r.include, true, nil
+			}
+		}
+	}
+	return false, false, nil
+}
+
+func (ig *ignoreRules) load(dir string) ([]filterRule, error) {
+	if rules, ok := ig.dirs[dir]; ok {
+		return rules, nil
+	}
+	var rules []filterRule
+	for _, name := range ig.names {
+		p := filepath.Join(ig.root, filepath.FromSlash(dir), name)
+		f, err := os.Open(p)
+		if os.IsNotExist(err) || isNotDir(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		rs, err := ReadIgnore(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+		frs, err := compileIgnore(rs)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+		rules = append(rules, frs...)
+	}
+	ig.dirs[dir] = rules
+	return rules, nil
+}
+
+// forget drops the rules read from the directory of the ignore file
+// at name, so that they are read again the next time they are needed.
+func (ig *ignoreRules) forget(name string) {
+	delete(ig.dirs, path.Dir(name))
+}
+
+func isNotDir(err error) bool {
+	var pe *os.PathError
+	return errors.As(err, &pe) && pe.Err == syscall.ENOTDIR
+}
+
+// excluded reports whether name is excluded by the filter, or by the
+// ignore files if none of the rules of the filter matches it.
+func excluded(f *Filter, ig *ignoreRules, name string, isDir bool) (bool, error) {
+	if excluded, ok := f.match(name, isDir); ok {
+		return excluded, nil
+	}
+	excluded, _, err := ig.match(name, isDir)
+	return excluded, err
+}
@@ -0,0 +1,98 @@
+package psync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestReadIgnore(t *testing.T) {
+	in := "# comment\n\n*.o\n!keep.o\n\\#hash\n\\!bang\nspace\\ \ntrail   \n"
+	got, err := ReadIgnore(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Rule{
+		{Pattern: "*.o"},
+		{Include: true, Pattern: "keep.o"},
+		{Pattern: `\#hash`},
+		{Pattern: `\!bang`},
+		{Pattern: `space\ `},
+		{Pattern: "trail"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ReadIgnore(...) mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestIgnoreRulesMatch(t *testing.T) {
+	root, err := ioutil.TempDir("", "psync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	files := map[string]string{
+		IgnoreFile:           "*.o\n!keep.o\nbuild/\n/top\ndoc/*.txt\nlogs/**\n\\#hash\n",
+		"a/" + IgnoreFile:    "!*.o\nsecret\n",
+		"a/b/" + IgnoreFile:  "*.o\n",
+		"g/" + GitIgnoreFile: "*.tmp\n",
+		"g/" + IgnoreFile:    "!x.tmp\n",
+	}
+	for p, data := range files {
+		p = filepath.Join(root, p)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{"x.c", false, false},
+		{"x.o", false, true},
+		{"c/x.o", false, true},
+		{"keep.o", false, false},
+		{"c/keep.o", false, false},
+		{"build", true, true},
+		{"build", false, false},
+		{"c/build", true, true},
+		{"top", false, true},
+		{"c/top", false, false},
+		{"doc/a.txt", false, true},
+		{"c/doc/a.txt", false, false},
+		{"logs", true, false},
+		{"logs/a/b", false, true},
+		{"#hash", false, true},
+		// child ignore files take precedence over their parents
+		{"a/x.o", false, false},
+		{"a/secret", false, true},
+		{"secret", false, false},
+		{"a/b/x.o", false, true},
+		{"a/b/keep.o", false, true},
+		// .psyncignore takes precedence over .gitignore
+		{"g/y.tmp", false, true},
+		{"g/x.tmp", false, false},
+	}
+	ig := newIgnoreRules(root, []string{GitIgnoreFile, IgnoreFile})
+	for _, tt := range tests {
+		got, _, err := ig.match(tt.path, tt.isDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("match(%q, %v) = %v, want %v", tt.path, tt.isDir, got, tt.want)
+		}
+	}
+	ig = newIgnoreRules(root, []string{IgnoreFile})
+	if got, _, _ := ig.match("g/y.tmp", false); got {
+		t.Errorf("%s read without being asked to", GitIgnoreFile)
+	}
+}
@@ -0,0 +1,117 @@
+package psync
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// nameCache looks up the names of user and group IDs on the sender
+// side. Names that cannot be looked up are cached as empty strings.
+type nameCache struct {
+	users, groups map[int]string
+}
+
+func (c *nameCache) user(uid int) string {
+	if name, ok := c.users[uid]; ok {
+		return name
+	}
+	if c.users == nil {
+		c.users = make(map[int]string)
+	}
+	var name string
+	if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+		name = u.Username
+	}
+	c.users[uid] = name
+	return name
+}
+
+func (c *nameCache) group(gid int) string {
+	if name, ok := c.groups[gid]; ok {
+		return name
+	}
+	if c.groups == nil {
+		c.groups = make(map[int]string)
+	}
+	var name string
+	if g, err := user.LookupGroupId(strconv.Itoa(gid)); err == nil {
+		name = g.Name
+	}
+	c.groups[gid] = name
+	return name
+}
+
+// idMapper maps the user and group names of the sender to the local
+// IDs on the receiver side. The numeric IDs of the sender are used as
+// they are when a name is not known locally, or not sent at all.
+type idMapper struct {
+	users, groups map[string]int
+}
+
+func (m *idMapper) uid(s *SrcFile) int {
+	if s.User == "" {
+		return s.Uid
+	}
+	if id, ok := m.users[s.User]; ok {
+		return id
+	}
+	if m.users == nil {
+		m.users = make(map[string]int)
+	}
+	id := -1
+	if u, err := user.Lookup(s.User); err == nil {
+		id, err = strconv.Atoi(u.Uid)
+		if err != nil {
+			id = -1
+		}
+	}
+	if id < 0 {
+		id = s.Uid
+	}
+	m.users[s.User] = id
+	return id
+}
+
+func (m *idMapper) gid(s *SrcFile) int {
+	if s.Group == "" {
+		return s.Gid
+	}
+	if id, ok := m.groups[s.Group]; ok {
+		return id
+	}
+	if m.groups == nil {
+		m.groups = make(map[string]int)
+	}
+	id := -1
+	if g, err := user.LookupGroup(s.Group); err == nil {
+		id, err = strconv.Atoi(g.Gid)
+		if err != nil {
+			id = -1
+		}
+	}
+	if id < 0 {
+		id = s.Gid
+	}
+	m.groups[s.Group] = id
+	return id
+}
+
+// chown applies the owner and the group of s to the file at path, as
+// requested by the session options. The owner is only changed when
+// running as root, as nobody else is allowed to give files away. It
+// clears the setuid and setgid bits, as well as the file capabilities,
+// so the mode and the extended attributes are set afterwards.
+func (r *Receiver) chown(path string, s *SrcFile) error {
+	uid, gid := -1, -1
+	if r.Opts.Owner && os.Geteuid() == 0 {
+		uid = r.ids.uid(s)
+	}
+	if r.Opts.Group {
+		gid = r.ids.gid(s)
+	}
+	if uid == -1 && gid == -1 {
+		return nil
+	}
+	return os.Lchown(path, uid, gid)
+}
@@ -0,0 +1,105 @@
+package psync
+
+import (
+	"crypto/md5"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestIDMapper(t *testing.T) {
+	u, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+	var tests = []struct {
+		in   SrcFile
+		want int
+	}{
+		// no name, numeric ID is used as is
+		{SrcFile{Uid: 1234}, 1234},
+		// known name, mapped to the local ID
+		{SrcFile{Uid: 1234, User: u.Username}, atoi(t, u.Uid)},
+		// unknown name, falls back to the numeric ID
+		{SrcFile{Uid: 1234, User: "psync-no-such-user"}, 1234},
+	}
+	var m idMapper
+	for _, tt := range tests {
+		if got := m.uid(&tt.in); got != tt.want {
+			t.Errorf("uid(%+v) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+	var c nameCache
+	if got := c.user(atoi(t, u.Uid)); got != u.Username {
+		t.Errorf("user(%s) = %q, want %q", u.Uid, got, u.Username)
+	}
+}
+
+func atoi(t *testing.T, s string) int {
+	t.Helper()
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestChownKeepsSetuid(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("chown requires root")
+	}
+	root, err := ioutil.TempDir("", "psync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err := ioutil.WriteFile(filepath.Join(root, "old"), []byte("hi"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	mode := os.ModeSetuid | os.ModeSetgid | 0755
+	list := []ReceiverSrcFile{
+		{SrcFile: SrcFile{Path: "new", Mode: mode, Size: 2, Mtime: time.Now()}},
+		{SrcFile: SrcFile{Path: "old", Mode: mode, Size: 2, Mtime: time.Now()}, chunkSize: 8},
+	}
+	sum := md5.Sum([]byte("yo"))
+	rcv := Receiver{
+		Root: root,
+		Dec: createFakeDecoder(
+			FileDesc{ID: 0, Typ: NewFile, TotalSize: 2},
+			[]byte("hi"),
+			FileDesc{ID: 1, Typ: PartialFile},
+			LocalBlockType,
+			LocalBlock{Size: 2},
+			[]byte("yo"),
+			FileSum,
+			sum[:],
+		),
+		Opts: Options{Owner: true, Group: true},
+	}
+	var res Result
+	if err := rcv.BuildFiles(len(list), list, &res); err != nil {
+		t.Fatal(err)
+	}
+	if err := res.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "attrs"), nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := rcv.setAttrs(&ReceiverSrcFile{SrcFile: SrcFile{Path: "attrs", Mode: mode}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"new", "old", "attrs"} {
+		info, err := os.Stat(filepath.Join(root, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode() != mode {
+			t.Errorf("%s: mode = %v, want %v", name, info.Mode(), mode)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package psync
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// DefaultPartialDir is the directory, under the root directory, the
+// files whose transfer has been interrupted are kept in, unless another
+// one is given.
+const DefaultPartialDir = ".psync-partial"
+
+var errPartialDir = errors.New("partial directory must be a relative path inside the root directory")
+
+// partialDir returns the directory the partial files are kept in.
+func (r *Receiver) partialDir() (string, error) {
+	dir := r.Opts.PartialDir
+	if dir == "" {
+		dir = DefaultPartialDir
+	}
+	return r.localDir(dir, errPartialDir)
+}
+
+// partialFile returns the path and the file info of the partial file
+// kept for s by an interrupted transfer, if there is one to resume it
+// from.
+func (r *Receiver) partialFile(s *ReceiverSrcFile) (string, os.FileInfo) {
+	if !r.Opts.Partial || r.Opts.Inplace || !s.transferred() {
+		return "", nil
+	}
+	dir, err := r.partialDir()
+	if err != nil {
+		return "", nil
+	}
+	name := filepath.Join(dir, s.Path)
+	info, err := osStat(name)
+	if err != nil || !info.Mode().IsRegular() {
+		return "", nil
+	}
+	return name, info
+}
+
+// keepPartial moves the file at name, the part of the file at rel
+// written before its transfer has been interrupted, into the partial
+// directory, if partial files are kept. It replaces the partial file
+// the transfer has been resumed from, if any.
+func (r *Receiver) keepPartial(name, rel string) {
+	if !r.Opts.Partial || r.Opts.Inplace {
+		return
+	}
+	dir, err := r.partialDir()
+	if err == nil {
+		p := filepath.Join(dir, rel)
+		if err = os.MkdirAll(filepath.Dir(p), 0755); err == nil {
+			err = os.Rename(name, p)
+		}
+	}
+	if err != nil {
+		log.Printf("failed to keep partial file %s: %v", rel, err)
+	}
+}
+
+// removePartial removes the partial file the file at rel has been
+// rebuilt from, along with the directories it leaves empty in the
+// partial directory.
+func (r *Receiver) removePartial(rel string) error {
+	dir, err := r.partialDir()
+	if err != nil {
+		return err
+	}
+	p := filepath.Join(dir, rel)
+	if err := os.Remove(p); err != nil {
+		return err
+	}
+	for p = filepath.Dir(p); len(p) >= len(dir); p = filepath.Dir(p) {
+		if os.Remove(p) != nil {
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package psync
+
+import (
+	"crypto/md5"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestBuildFilesPartial(t *testing.T) {
+	root, err := ioutil.TempDir("", "psync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	list := []ReceiverSrcFile{
+		{SrcFile: SrcFile{Path: "dir/big", Mode: 0644, Size: 10, Mtime: time.Now()}},
+	}
+	rcv := Receiver{Root: root, Opts: Options{Partial: true}}
+
+	// the connection drops in the middle of the file
+	rcv.Dec = createFakeDecoder(
+		FileDesc{ID: 0, Typ: NewFile, TotalSize: 10},
+		[]byte("hello"),
+	)
+	var res Result
+	if err := rcv.BuildFiles(1, list, &res); err == nil {
+		t.Fatal("BuildFiles(...) succeeded on a truncated stream")
+	}
+	partial := filepath.Join(root, DefaultPartialDir, "dir/big")
+	b, err := ioutil.ReadFile(partial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Errorf("partial file = %q, want %q", b, "hello")
+	}
+	if _, err := os.Lstat(filepath.Join(root, "dir/big")); !os.IsNotExist(err) {
+		t.Errorf("dir/big exists: %v", err)
+	}
+
+	// the next sync rebuilds the file from the partial one
+	var enc mergeDscEnc
+	if _, err := rcv.SendDstFileList(8, list, &enc); err != nil {
+		t.Fatal(err)
+	}
+	dst, ok := enc[1].(DstFile)
+	if !ok || dst.Type != DstFileSimilar || dst.Size != 5 || list[0].partial == "" {
+		t.Fatalf("SendDstFileList(...) = %v, want the partial file as the basis", enc)
+	}
+	sum := md5.Sum([]byte("helloworld"))
+	rcv.Dec = createFakeDecoder(
+		FileDesc{ID: 0, Typ: PartialFile},
+		RemoteBlockType,
+		RemoteBlock{ChunkID: 0, NrChunks: 1, Off: 0},
+		LocalBlockType,
+		LocalBlock{Off: 5, Size: 5},
+		[]byte("world"),
+		FileSum,
+		sum[:],
+	)
+	res = Result{}
+	if err := rcv.BuildFiles(1, list, &res); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(Result{Updated: []string{"dir/big"}}, res); diff != "" {
+		t.Errorf("BuildFiles(...) mismatch (-want +got):\n%s", diff)
+	}
+	if b, err = ioutil.ReadFile(filepath.Join(root, "dir/big")); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "helloworld" {
+		t.Errorf("dir/big = %q, want %q", b, "helloworld")
+	}
+	if _, err := os.Lstat(filepath.Join(root, DefaultPartialDir)); !os.IsNotExist(err) {
+		t.Errorf("partial directory has not been removed: %v", err)
+	}
+}
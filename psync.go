@@ -4,13 +4,14 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"time"
 )
 
-//go:generate stringer -type=FileType,FileListType,DstFileType,BlockType -output types_string.go
+//go:generate stringer -type=FileType,FileListType,DstFileType,BlockType,ErrorCode -output types_string.go
 
 type Encoder interface {
 	Encode(e interface{}) error
@@ -32,28 +33,54 @@ type DecodeReader interface {
 
 var ProtoMagic = [...]byte{'p', 's', 'y', 'n'}
 
-// Handshake represents a 8-byte protocol header
+// Handshake represents a 10-byte protocol header. Both peers send one
+// right after the connection is established, advertising the range of
+// protocol versions, the wire formats and the optional features they
+// support. The first 8 bytes are laid out the same way as in version 1
+// of the protocol, so that old peers can still tell the versions apart.
 type Handshake struct {
-	Magic      [4]byte
-	Version    uint16
-	WireFormat byte
-	Flags      byte
+	Magic       [4]byte
+	Version     uint16 // highest supported protocol version
+	WireFormats byte   // bit set of supported wire formats
+	Flags       byte   // bit set of supported features
+	MinVersion  uint16 // lowest supported protocol version
 }
 
 const (
 	// Wire format encoders
 	WireFormatGob = iota
+	WireFormatBinary
 
 	// Supported flags
 	CompressGzip = 1 << 0
 )
 
-func NewHandshake(version uint16, wireFormat, flags byte) *Handshake {
+const (
+	// ProtoVersion is the highest protocol version spoken by this package.
+	ProtoVersion = 20
+
+	// MinProtoVersion is the lowest protocol version still spoken by
+	// this package.
+	MinProtoVersion = 20
+)
+
+// WireFormatSet returns the bit set of the given wire formats suitable
+// for the WireFormats field of a Handshake.
+func WireFormatSet(formats ...byte) byte {
+	var set byte
+	for _, f := range formats {
+		set |= 1 << f
+	}
+	return set
+}
+
+func NewHandshake(version uint16, wireFormats, flags byte) *Handshake {
 	h := &Handshake{
-		Magic:      [4]byte{'p', 's', 'y', 'n'},
-		Version:    version,
-		WireFormat: wireFormat,
-		Flags:      flags,
+		Magic:       [4]byte{'p', 's', 'y', 'n'},
+		Version:     version,
+		WireFormats: wireFormats,
+		Flags:       flags,
+		MinVersion:  version,
 	}
 	return h
 }
@@ -70,7 +97,7 @@ func (h *Handshake) WriteTo(w io.Writer) (int64, error) {
 	if err != nil {
 		return 0, err
 	}
-	err = b.WriteByte(h.WireFormat)
+	err = b.WriteByte(h.WireFormats)
 	if err != nil {
 		return 0, err
 	}
@@ -78,16 +105,21 @@ func (h *Handshake) WriteTo(w io.Writer) (int64, error) {
 	if err != nil {
 		return 0, err
 	}
+	binary.BigEndian.PutUint16(s[:], h.MinVersion)
+	_, err = b.Write(s[:])
+	if err != nil {
+		return 0, err
+	}
 	_, err = b.WriteTo(w)
 	if err != nil {
 		return 0, err
 	}
-	return 8, nil
+	return 10, nil
 }
 
 // Valid determines whether this is a valid Handshake header. Note that
-// this function does nothing with the protocol version, you need to
-// explicitly check the required protocol version yourself.
+// this function does nothing with the protocol version, use Negotiate
+// to find out whether two peers can talk to each other.
 func (h *Handshake) Valid() bool { return bytes.Equal(ProtoMagic[:], h.Magic[:]) }
 
 // ReadHandshake tries to decode bytes read from r into a Handshake structure.
@@ -98,23 +130,215 @@ func (h *Handshake) Valid() bool { return bytes.Equal(ProtoMagic[:], h.Magic[:])
 // of time, then we'll close the connection.
 func ReadHandshake(r io.Reader) (Handshake, error) {
 	var h Handshake
-	var p [8]byte
-	_, err := io.ReadFull(r, p[:])
+	var p [10]byte
+	_, err := io.ReadFull(r, p[:8])
 	if err != nil {
 		return Handshake{}, err
 	}
 	copy(h.Magic[:], p[:4])
 	h.Version = binary.BigEndian.Uint16(p[4:6])
-	h.WireFormat = p[6]
+	h.WireFormats = p[6]
 	h.Flags = p[7]
+	// version 1 headers end here
+	if h.Version < 2 {
+		h.MinVersion = h.Version
+		return h, nil
+	}
+	_, err = io.ReadFull(r, p[8:])
+	if err != nil {
+		return Handshake{}, err
+	}
+	h.MinVersion = binary.BigEndian.Uint16(p[8:10])
 	return h, nil
 }
 
+// Agreement is the outcome of a handshake, the settings both peers use
+// for the rest of the session.
+type Agreement struct {
+	Version    uint16
+	WireFormat byte
+	Flags      byte
+}
+
+// Negotiate settles on the highest protocol version, the preferred wire
+// format and the set of features supported by both the local and the
+// remote peer. Both peers reach the same agreement independently, as
+// the outcome does not depend on the order of the arguments.
+func Negotiate(local, remote *Handshake) (Agreement, error) {
+	var a Agreement
+	if !remote.Valid() {
+		return a, errors.New("invalid protocol header")
+	}
+	lo, hi := local.MinVersion, local.Version
+	if remote.MinVersion > lo {
+		lo = remote.MinVersion
+	}
+	if remote.Version < hi {
+		hi = remote.Version
+	}
+	if lo > hi {
+		return a, fmt.Errorf(
+			"no common protocol version: local peer speaks %d-%d, remote peer speaks %d-%d",
+			local.MinVersion, local.Version, remote.MinVersion, remote.Version,
+		)
+	}
+	a.Version = hi
+	common := local.WireFormats & remote.WireFormats
+	if common == 0 {
+		return a, fmt.Errorf(
+			"no common wire format: local peer supports %#02x, remote peer supports %#02x",
+			local.WireFormats, remote.WireFormats,
+		)
+	}
+	// prefer the most recently added wire format
+	for f := byte(7); ; f-- {
+		if common&(1<<f) != 0 {
+			a.WireFormat = f
+			break
+		}
+	}
+	a.Flags = local.Flags & remote.Flags
+	return a, nil
+}
+
+// Options are the settings the sender asks the receiver to apply for
+// the rest of the session. They are sent once, right after the
+// handshake.
+type Options struct {
+	// Preserve the owner (requires root) and the group of the
+	// files and directories created or updated by the receiver.
+	Owner, Group bool
+
+	// Checksum makes the receiver send the digests of the files that
+	// have the same size on both sides, and the sender skip the ones
+	// with matching digests, whatever their modification times are.
+	Checksum bool
+
+	// DryRun makes the receiver report what it would do without
+	// changing anything.
+	DryRun bool
+
+	// Filter is the list of the rules the src file list has been
+	// filtered with. The receiver does not delete the files they
+	// exclude, unless DeleteExcluded is set.
+	Filter         []Rule
+	DeleteExcluded bool
+
+	// IgnoreFiles are the names of the per directory ignore files the
+	// src file list has been filtered with. The receiver reads its own
+	// copies of them, and does not delete the files they exclude either,
+	// unless DeleteExcluded is set.
+	IgnoreFiles []string
+
+	// Delete selects when the receiver deletes the files missing from
+	// the src file list, if the sender asks it to.
+	Delete DeleteTiming
+
+	// MaxDelete, if positive, is the maximum number of files the
+	// receiver deletes in a single sync. It deletes none of them if
+	// there are more.
+	MaxDelete int
+
+	// Protect is the list of the rules of a filter whose excluded files
+	// are never deleted, whatever the other options are.
+	Protect []Rule
+
+	// Backup makes the receiver keep the files it replaces or deletes.
+	// They are renamed with BackupSuffix appended to their names, or
+	// moved into a parallel tree under BackupDir, a directory relative
+	// to the root directory, if it is set. BackupTimestamp puts the
+	// backups of every sync into their own subdirectory of BackupDir,
+	// named after the time the sync has started at.
+	Backup          bool
+	BackupSuffix    string
+	BackupDir       string
+	BackupTimestamp bool
+
+	// TempDir is the directory, relative to the root directory, the
+	// updated files are rebuilt in. By default they are rebuilt next
+	// to the files they replace.
+	TempDir string
+
+	// DelayUpdates makes the receiver stage the files it rebuilds, and
+	// move them into place at the end of the transfer, only if all of
+	// them have been rebuilt successfully.
+	DelayUpdates bool
+
+	// Inplace makes the receiver rebuild the files over their existing
+	// contents, instead of in temporary files, so that huge files do
+	// not take twice their size on disk while being updated. Readers
+	// see the files half-updated meanwhile. The sender must not reuse
+	// the blocks the receiver has already overwritten.
+	Inplace bool
+
+	// Partial makes the receiver keep the part of a file transferred
+	// before the transfer has been interrupted, under PartialDir, a
+	// directory relative to the root directory, or DefaultPartialDir
+	// if it is not set. The next sync resumes the transfer, rebuilding
+	// the file from the kept data. In Inplace mode, the files are left
+	// in place and resumed from anyway.
+	Partial    bool
+	PartialDir string
+
+	// Sparse makes the receiver leave holes in the files it creates or
+	// rebuilds where their contents are zeros, instead of allocating
+	// disk space for them. Inplace updates don't punch holes into the
+	// existing files.
+	Sparse bool
+
+	// Xattrs and ACLs make the receiver apply the extended attributes,
+	// and the POSIX ACLs respectively, of the source files and
+	// directories to its own copies. Only the user namespace and the
+	// ACLs are applied unless it is running as root.
+	Xattrs bool
+	ACLs   bool
+
+	// Devices and Specials allow the receiver to create the device
+	// nodes, and the named pipes and sockets respectively, in the src
+	// file list.
+	Devices  bool
+	Specials bool
+
+	// Skip policies of the receiver. SizeOnly takes the files of the
+	// same size to be up to date, whatever their modification times
+	// are, while IgnoreTimes updates them all. Update leaves alone the
+	// files that are newer than the source ones, IgnoreExisting all the
+	// existing files, and Existing creates no new files. The
+	// modification times at most ModifyWindow apart are taken to be
+	// the same, for filesystems with coarse timestamps.
+	SizeOnly       bool
+	IgnoreTimes    bool
+	Update         bool
+	IgnoreExisting bool
+	Existing       bool
+	ModifyWindow   time.Duration
+}
+
+// DeleteTiming selects when the receiver deletes the extraneous files.
+type DeleteTiming byte
+
+const (
+	// DeleteBefore deletes them before the transfer starts.
+	DeleteBefore DeleteTiming = iota
+
+	// DeleteDuring deletes them once the receiver has sent its file
+	// list, while the sender is computing the deltas.
+	DeleteDuring
+
+	// DeleteAfter deletes them once all the files are transferred,
+	// so that the new ignore files are in place by then.
+	DeleteAfter
+)
+
 type FileType byte
 
 const (
 	NewFile FileType = iota
 	PartialFile
+
+	// IdenticalFile is sent for files whose contents are found to be
+	// identical in checksum mode. Only their attributes are updated.
+	IdenticalFile
 )
 
 type FileDesc struct {
@@ -168,8 +392,69 @@ type SrcFile struct {
 	Mode     os.FileMode
 	Size     int64
 	Mtime    time.Time
+
+	// User and group names of Uid and Gid, only set if the receiver
+	// is asked to map them to its own IDs.
+	User, Group string
+
+	// Target of a symbolic link
+	Target string
+
+	// Rdev is the device number of a device node.
+	Rdev uint64
+
+	// Skipped is set for the regular files the sender leaves out of the
+	// transfer because of their sizes. They are listed nonetheless, so
+	// that the receiver does not delete its copies of them.
+	Skipped bool
+
+	// Leader is the index of the first entry in the file list that is
+	// a hard link to the same file, plus one. The zero value means the
+	// file is not linked to any of the files listed before.
+	Leader int
+
+	// Extended attributes of a regular file or directory, sorted by
+	// name, only listed if the receiver is asked to preserve them.
+	// POSIX ACLs are among them.
+	Xattrs []Xattr
 }
 
+// Xattr is an extended attribute of a file.
+type Xattr struct {
+	Name  string
+	Value []byte
+}
+
+// transferred reports whether the contents of f are sent in the block
+// stream, as opposed to links and directories which are created by the
+// receiver on its own.
+func (f *SrcFile) transferred() bool { return f.Mode.IsRegular() && f.Leader == 0 && !f.Skipped }
+
+// Changes is a set of the attributes of an existing file that differ
+// from the ones of the source file.
+type Changes uint16
+
+const (
+	ChangeSize Changes = 1 << iota
+	ChangeTime
+	ChangePerms
+	ChangeOwner
+	ChangeGroup
+
+	// ChangeChecksum is set by the sender for the files whose
+	// contents, or the targets of symbolic links, differ.
+	ChangeChecksum
+
+	// ChangeACL is set for the files whose POSIX ACLs differ, in
+	// ACLs mode. It shows as an 'a' in the itemized changes.
+	ChangeACL
+
+	// ChangeXattrs is set for the files whose extended attributes
+	// differ, in xattrs mode. It shows as an 'x' in the itemized
+	// changes.
+	ChangeXattrs
+)
+
 type DstFileType int
 
 const (
@@ -189,6 +474,16 @@ type DstFile struct {
 	Size int64
 
 	Type DstFileType
+
+	// MD5 digest of the whole file, only sent in checksum mode for
+	// the files of the same size as the source file. If ChunkSize is
+	// zero, the block sums are not sent along with it, but only once
+	// the sender has found it to differ from the one of its copy.
+	Sum []byte
+
+	// Changes lists the attributes of an existing regular file or
+	// directory that differ from the ones of the source file.
+	Changes Changes
 }
 
 func (b *DstFile) NumChunks() int {
@@ -8,6 +8,9 @@ import (
 	"encoding/hex"
 	stdadler32 "hash/adler32"
 	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
@@ -219,7 +222,7 @@ func TestMergeDesc(t *testing.T) {
 		},
 	}
 	enc := &mergeDscEnc{}
-	if err = sendBlockDescs(f, 22, src, enc); err != nil {
+	if err = sendBlockDescs(f, 22, src, enc, new(Stats), false); err != nil {
 		t.Fatal(err)
 	}
 	if diff := cmp.Diff(want, enc); diff != "" {
@@ -580,6 +583,84 @@ func TestHandshake(t *testing.T) {
 	}
 }
 
+func TestReadHandshakeV1(t *testing.T) {
+	// version 1 headers are 8 bytes long, nothing past them should be
+	// consumed.
+	b := bytes.NewBuffer([]byte{'p', 's', 'y', 'n', 0, 1, WireFormatGob, 0, 0xff})
+	got, err := ReadHandshake(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := NewHandshake(1, WireFormatGob, 0)
+	if !reflect.DeepEqual(&got, want) {
+		t.Fatalf("ReadHandshake(...) = %#v, want %#v", got, want)
+	}
+	if b.Len() != 1 {
+		t.Fatalf("ReadHandshake(...) consumed %d extra bytes", 1-b.Len())
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	hs := func(min, max uint16, wireFormats, flags byte) *Handshake {
+		h := NewHandshake(max, wireFormats, flags)
+		h.MinVersion = min
+		return h
+	}
+	all := WireFormatSet(WireFormatGob, WireFormatBinary)
+	gob := WireFormatSet(WireFormatGob)
+	var tests = []struct {
+		local, remote *Handshake
+		want          Agreement
+		fail          bool
+	}{
+		{
+			local:  hs(MinProtoVersion, ProtoVersion, all, CompressGzip),
+			remote: hs(MinProtoVersion, ProtoVersion, all, CompressGzip),
+			want:   Agreement{Version: ProtoVersion, WireFormat: WireFormatBinary, Flags: CompressGzip},
+		},
+		// a newer peer still speaking our version
+		{
+			local:  hs(MinProtoVersion, ProtoVersion, gob, CompressGzip),
+			remote: hs(MinProtoVersion, ProtoVersion+1, all, 0),
+			want:   Agreement{Version: ProtoVersion, WireFormat: WireFormatGob},
+		},
+		// a peer from before the handshake has been introduced
+		{
+			local:  hs(MinProtoVersion, ProtoVersion, all, 0),
+			remote: hs(1, 1, all, 0),
+			fail:   true,
+		},
+		// a newer peer no longer speaking our version
+		{
+			local:  hs(MinProtoVersion, ProtoVersion, all, 0),
+			remote: hs(ProtoVersion+1, ProtoVersion+2, all, 0),
+			fail:   true,
+		},
+		{
+			local:  hs(MinProtoVersion, ProtoVersion, gob, 0),
+			remote: hs(MinProtoVersion, ProtoVersion, WireFormatSet(WireFormatBinary), 0),
+			fail:   true,
+		},
+	}
+	for i, tt := range tests {
+		for _, p := range [][2]*Handshake{{tt.local, tt.remote}, {tt.remote, tt.local}} {
+			got, err := Negotiate(p[0], p[1])
+			if tt.fail {
+				if err == nil {
+					t.Errorf("%d: Negotiate(...) = %+v, want error", i, got)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%d: Negotiate(...): %v", i, err)
+			}
+			if got != tt.want {
+				t.Errorf("%d: Negotiate(...) = %+v, want %+v", i, got, tt.want)
+			}
+		}
+	}
+}
+
 /*
 func TestRollingReader(t *testing.T) {
 	var tt = []struct {
@@ -707,3 +788,79 @@ func TestExample(t *testing.T) {
 	// ver the lazy dog: checksum 326205e9
 }
 */
+
+func TestBuildFilesInplace(t *testing.T) {
+	const (
+		old = "abcdefghijklmnop"
+		new = "ijklabcdmnop"
+	)
+	for _, inplace := range []bool{false, true} {
+		root, err := ioutil.TempDir("", "psync")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(root)
+		if err := ioutil.WriteFile(filepath.Join(root, "f"), []byte(old), 0644); err != nil {
+			t.Fatal(err)
+		}
+		src := &SenderSrcFile{SrcFile: SrcFile{Path: "f", Size: int64(len(new))}}
+		src.dst = SenderDstFile{
+			DstFile: DstFile{Type: DstFileSimilar, ChunkSize: 4, Size: int64(len(old))},
+			sums:    make(map[uint32]SenderBlockSum),
+		}
+		for i := 0; i < len(old); i += 4 {
+			b := []byte(old[i : i+4])
+			sum := md5.Sum(b)
+			rsum := adler32.New()
+			rsum.Write(b)
+			src.dst.sums[rsum.Sum32()] = SenderBlockSum{
+				id:       i / 4,
+				BlockSum: BlockSum{Rsum: rsum.Sum32(), Csum: sum[:]},
+			}
+		}
+		var buf bytes.Buffer
+		enc := struct {
+			*gob.Encoder
+			io.Writer
+		}{gob.NewEncoder(&buf), &buf}
+		var st Stats
+		if err := sendBlockDescs(strings.NewReader(new), 0, src, enc, &st, inplace); err != nil {
+			t.Fatal(err)
+		}
+		// in place, the 1st and the 2nd blocks are overwritten before
+		// they could be reused.
+		want := Stats{Literal: 0, Matched: 12}
+		if inplace {
+			want = Stats{Literal: 4, Matched: 8}
+		}
+		if st != want {
+			t.Errorf("inplace %v: got %+v, want %+v", inplace, st, want)
+		}
+		rcv := Receiver{
+			Root: root,
+			Opts: Options{Inplace: inplace},
+			Dec: struct {
+				*gob.Decoder
+				io.Reader
+			}{gob.NewDecoder(&buf), &buf},
+		}
+		list := []ReceiverSrcFile{{
+			SrcFile:   SrcFile{Path: "f", Mode: 0644, Size: int64(len(new)), Mtime: time.Now()},
+			chunkSize: 4,
+		}}
+		var res Result
+		if err := rcv.BuildFiles(1, list, &res); err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Failed) != 0 {
+			t.Fatalf("inplace %v: %v", inplace, res.Failed)
+		}
+		b, err := ioutil.ReadFile(filepath.Join(root, "f"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != new {
+			t.Errorf("inplace %v: got %q, want %q", inplace, b, new)
+		}
+	}
+}
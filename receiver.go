@@ -12,6 +12,10 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
 )
 
 type ReceiverSrcFile struct {
@@ -20,74 +24,366 @@ type ReceiverSrcFile struct {
 	// following fields are not serialized
 	dstFileSize int64
 	chunkSize   int // used by receiver only
+
+	// state of the file on the receiver side, as sent back to the
+	// sender in the dst file list, and the attributes that differ.
+	state   DstFileType
+	changes Changes
+
+	// path of the partial file kept by an interrupted transfer, which
+	// the file is rebuilt from rather than from its existing copy.
+	partial string
+
+	// the file is left alone as requested by the skip policies of the
+	// session. It is reported to the sender as identical.
+	skipped bool
+
+	// digest of the file, sent without its block sums, which are sent
+	// by SendMismatchChunks if the sender finds it to differ.
+	sum []byte
 }
 
 type Receiver struct {
 	Root string
 	Dec  DecodeReader
+	Opts Options
+
+	// SyncTime is the time the current sync has started at. It names
+	// the timestamped backup directories.
+	SyncTime time.Time
+
+	ids idMapper
+
+	// files rebuilt in the staging directory in delay-updates mode
+	staged []string
 }
 
-func (r *Receiver) BuildFiles(nrChangedFiles int, srcFiles []ReceiverSrcFile) error {
+// BuildFiles builds the files described by the next nrChangedFiles file
+// descriptors. A failure confined to a single file, such as a
+// permission error or a full disk, is recorded in res and the rest of
+// the files are built anyway. Only the errors that leave the block
+// stream out of sync with the sender are returned.
+//
+// In delay-updates mode the files are built in the staging directory,
+// and moved into place at the end, only if all of them have been built
+// successfully.
+func (r *Receiver) BuildFiles(nrChangedFiles int, srcFiles []ReceiverSrcFile, res *Result) error {
+	nfailed := len(res.Failed)
+	if r.Opts.DelayUpdates {
+		// left behind by an interrupted sync
+		if err := os.RemoveAll(filepath.Join(r.Root, StagingDir)); err != nil {
+			return err
+		}
+	}
 	for i := 0; i < nrChangedFiles; i++ {
-		err := r.buildFile(srcFiles)
+		err := r.buildFile(srcFiles, res)
 		if err != nil {
+			if r.Opts.DelayUpdates {
+				r.dropStaged(res)
+			}
 			return err
 		}
 	}
-	return nil
+	if !r.Opts.DelayUpdates {
+		return nil
+	}
+	if len(res.Failed) > nfailed {
+		log.Printf("not moving %d staged file(s) into place", len(r.staged))
+		return r.dropStaged(res)
+	}
+	return r.commitStaged(res)
 }
 
-func (r *Receiver) buildFile(srcFiles []ReceiverSrcFile) error {
+func (r *Receiver) buildFile(srcFiles []ReceiverSrcFile, res *Result) error {
 	var fd FileDesc
 	if err := r.Dec.Decode(&fd); err != nil {
 		return fmt.Errorf("buildfile: %w", err)
 	}
-	if fd.ID < 0 && fd.ID > len(srcFiles) {
+	if fd.ID < 0 || fd.ID >= len(srcFiles) {
 		return fmt.Errorf("there is no such file with id: %d", fd.ID)
 	}
-	// handle new file scenario do io.Copy or something like that
-	if fd.Typ == NewFile {
-		return r.create(&srcFiles[fd.ID])
-	}
-	if fd.Typ != PartialFile {
+	s := &srcFiles[fd.ID]
+	var err error
+	switch fd.Typ {
+	case NewFile:
+		// handle new file scenario do io.Copy or something like that
+		err = r.create(s)
+	case PartialFile:
+		if r.Opts.Inplace {
+			err = r.updateInplace(s)
+		} else {
+			err = r.update(s)
+		}
+	case IdenticalFile:
+		err = r.setAttrs(s)
+	default:
 		return fmt.Errorf("unrecognized file descriptor type: %v", fd.Typ)
 	}
-	// TODO: if we send file descriptors and create files at the same
-	// time, this temporary file may end up in the receiver file list,
-	// which is not we want.
-	tmp, err := ioutil.TempFile(r.Root, "psync*.tmp")
-	// tmp, err := ioutil.TempFile("/tmp/cache", "psync*.tmp")
 	if err != nil {
+		res.addFailure(s.Path, err)
+		var ferr *fileError
+		if errors.As(err, &ferr) {
+			return nil
+		}
 		return err
 	}
+	switch fd.Typ {
+	case NewFile:
+		res.Created = append(res.Created, s.Path)
+	case PartialFile:
+		res.Updated = append(res.Updated, s.Path)
+	}
+	if r.Opts.DelayUpdates && fd.Typ != IdenticalFile {
+		r.staged = append(r.staged, s.Path)
+	}
+	return nil
+}
+
+// setAttrs applies the attributes of s to the existing file, whose
+// contents are already up to date.
+func (r *Receiver) setAttrs(s *ReceiverSrcFile) error {
+	name := filepath.Join(r.Root, s.Path)
+	if err := r.chown(name, &s.SrcFile); err != nil {
+		return &fileError{err}
+	}
+	if err := r.setXattrs(name, &s.SrcFile); err != nil {
+		return &fileError{err}
+	}
+	if err := os.Chmod(name, s.Mode); err != nil {
+		return &fileError{err}
+	}
+	if err := os.Chtimes(name, s.Mtime, s.Mtime); err != nil {
+		return &fileError{err}
+	}
+	return nil
+}
+
+func (r *Receiver) update(s *ReceiverSrcFile) error {
+	name, err := r.target(s.Path)
+	if err != nil {
+		return r.skipBlocks(err)
+	}
+	tmp, err := r.tempFile(name)
+	if err != nil {
+		return r.skipBlocks(err)
+	}
 	defer tmp.Close()
 	defer os.Remove(tmp.Name())
-	s := &srcFiles[fd.ID]
-	f, err := os.Open(filepath.Join(r.Root, s.Path))
+	basis := filepath.Join(r.Root, s.Path)
+	if s.partial != "" {
+		basis = s.partial
+	}
+	f, err := os.Open(basis)
 	if err != nil {
-		return err
+		return r.skipBlocks(err)
 	}
 	defer f.Close()
-	if err = r.merge(s, f, tmp); err != nil {
+	w := errWriter{w: tmp}
+	var sw *sparseWriter
+	if r.Opts.Sparse {
+		sw = &sparseWriter{f: tmp}
+		w.w = sw
+	}
+	rd := errReaderAt{r: f}
+	err = r.merge(s, &rd, &w)
+	if err != nil && !errors.Is(err, errChecksumMismatch) {
+		if w.err == nil && rd.err == nil {
+			r.keepPartial(tmp.Name(), s.Path)
+		}
 		return err
 	}
+	if sw != nil && w.err == nil {
+		w.err = sw.finish()
+	}
+	// local I/O errors are the likely cause of a checksum mismatch,
+	// so report them first.
+	for _, e := range []error{w.err, rd.err, err} {
+		if e != nil {
+			return &fileError{e}
+		}
+	}
+	if err := r.chown(tmp.Name(), &s.SrcFile); err != nil {
+		return &fileError{err}
+	}
+	if err := r.setXattrs(tmp.Name(), &s.SrcFile); err != nil {
+		return &fileError{err}
+	}
 	if err := tmp.Chmod(s.Mode); err != nil {
-		return err
+		return &fileError{err}
 	}
-	if err := os.Rename(tmp.Name(), f.Name()); err != nil {
-		return err
+	// staged files are backed up as they are moved into place
+	if !r.Opts.DelayUpdates {
+		if _, err := r.backup(s.Path); err != nil {
+			return &fileError{err}
+		}
+	}
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		return &fileError{err}
+	}
+	if err := os.Chtimes(name, s.Mtime, s.Mtime); err != nil {
+		return &fileError{err}
+	}
+	if s.partial != "" {
+		if err := r.removePartial(s.Path); err != nil {
+			return &fileError{err}
+		}
 	}
-	return os.Chtimes(f.Name(), s.Mtime, s.Mtime)
+	return nil
 }
 
-func (r *Receiver) merge(s *ReceiverSrcFile, rd io.ReaderAt, tmp io.Writer) error {
-	fb, err := os.Create("/tmp/pp.log")
+// updateInplace rebuilds the file over its existing contents, which the
+// sender only reuses before they are overwritten, and truncates it to
+// its new size. A failure leaves the file half-updated.
+func (r *Receiver) updateInplace(s *ReceiverSrcFile) error {
+	name := filepath.Join(r.Root, s.Path)
+	if err := r.backupCopy(s.Path); err != nil {
+		return r.skipBlocks(err)
+	}
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
 	if err != nil {
-		panic(err)
+		return r.skipBlocks(err)
+	}
+	defer f.Close()
+	w := inplaceWriter{f: f}
+	rd := errReaderAt{r: f}
+	err = r.merge(s, &rd, &w)
+	if err != nil && !errors.Is(err, errChecksumMismatch) {
+		return err
+	}
+	for _, e := range []error{w.err, rd.err, err} {
+		if e != nil {
+			return &fileError{e}
+		}
+	}
+	if err := f.Truncate(s.Size); err != nil {
+		return &fileError{err}
+	}
+	if err := r.chown(name, &s.SrcFile); err != nil {
+		return &fileError{err}
+	}
+	if err := r.setXattrs(name, &s.SrcFile); err != nil {
+		return &fileError{err}
+	}
+	if err := f.Chmod(s.Mode); err != nil {
+		return &fileError{err}
+	}
+	if err := os.Chtimes(name, s.Mtime, s.Mtime); err != nil {
+		return &fileError{err}
+	}
+	return nil
+}
+
+// inplaceWriter writes to the file being rebuilt over its own contents.
+// Like errWriter, it keeps going after a failed write.
+type inplaceWriter struct {
+	f   *os.File
+	off int64
+	err error
+}
+
+func (w *inplaceWriter) Write(p []byte) (int, error) {
+	if w.err == nil {
+		_, w.err = w.f.WriteAt(p, w.off)
+	}
+	w.off += int64(len(p))
+	return len(p), nil
+}
+
+// skip moves past n bytes that are already in place.
+func (w *inplaceWriter) skip(n int64) { w.off += n }
+
+// skipBlocks consumes the block descriptors of the current file up to
+// and including its checksum without building anything, and returns err
+// as a fileError.
+func (r *Receiver) skipBlocks(err error) error {
+	for {
+		var typ BlockType
+		if derr := r.Dec.Decode(&typ); derr != nil {
+			return fmt.Errorf("failed to decode BlockType: %w", derr)
+		}
+		switch typ {
+		case LocalBlockType:
+			var lb LocalBlock
+			if derr := r.Dec.Decode(&lb); derr != nil {
+				return derr
+			}
+			if _, derr := io.CopyN(ioutil.Discard, r.Dec, lb.Size); derr != nil {
+				return derr
+			}
+		case RemoteBlockType:
+			var rb RemoteBlock
+			if derr := r.Dec.Decode(&rb); derr != nil {
+				return derr
+			}
+		case FileSum:
+			var fileSum []byte
+			if derr := r.Dec.Decode(&fileSum); derr != nil {
+				return derr
+			}
+			return &fileError{err}
+		default:
+			return fmt.Errorf("unexpected block type: %v", typ)
+		}
+	}
+}
+
+// discard consumes n bytes of raw file data and returns err as a
+// fileError.
+func (r *Receiver) discard(n int64, err error) error {
+	if _, derr := io.CopyN(ioutil.Discard, r.Dec, n); derr != nil {
+		return derr
+	}
+	return &fileError{err}
+}
+
+// fileError wraps errors confined to a single file. The block stream is
+// still in sync with the sender after them, so the receiver can go on
+// with the next file.
+type fileError struct{ err error }
+
+func (e *fileError) Error() string { return e.err.Error() }
+func (e *fileError) Unwrap() error { return e.err }
+
+// errWriter passes writes through to w until the first error, after
+// which it keeps discarding the data so that the caller can go on
+// consuming the block stream.
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (e *errWriter) Write(p []byte) (int, error) {
+	if e.err == nil {
+		_, e.err = e.w.Write(p)
+	}
+	return len(p), nil
+}
+
+// errReaderAt is the io.ReaderAt counterpart of errWriter. Failed reads
+// are filled with zeros, which is bound to be caught by the checksum.
+type errReaderAt struct {
+	r   io.ReaderAt
+	err error
+}
+
+func (e *errReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := e.r.ReadAt(p, off)
+	if err == nil || err == io.EOF {
+		return n, err
+	}
+	if e.err == nil {
+		e.err = err
 	}
-	defer fb.Close()
+	for i := n; i < len(p); i++ {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func (r *Receiver) merge(s *ReceiverSrcFile, rd io.ReaderAt, tmp io.Writer) error {
 	sum := md5.New()
-	tmp = io.MultiWriter(tmp, sum, fb)
+	iw, inplace := tmp.(*inplaceWriter)
+	tmp = io.MultiWriter(tmp, sum)
 	var off int64
 	for off < s.Size {
 		var typ BlockType
@@ -134,8 +430,14 @@ func (r *Receiver) merge(s *ReceiverSrcFile, rd io.ReaderAt, tmp io.Writer) erro
 			if off != rb.Off {
 				return fmt.Errorf("remote bad file offset: want %d, got: %d", rb.Off, off)
 			}
+			w := io.MultiWriter(tmp, &b)
+			// blocks already in place only need to be summed
+			inPlace := inplace && int64(rb.ChunkID*s.chunkSize) == off
+			if inPlace {
+				w = io.MultiWriter(sum, &b)
+			}
 			n, err := io.Copy(
-				io.MultiWriter(tmp, &b),
+				w,
 				io.NewSectionReader(
 					rd,
 					int64(rb.ChunkID*s.chunkSize),
@@ -143,6 +445,9 @@ func (r *Receiver) merge(s *ReceiverSrcFile, rd io.ReaderAt, tmp io.Writer) erro
 				),
 			)
 			off += n
+			if inPlace {
+				iw.skip(n)
+			}
 			if err != nil {
 				// last block may be smaller than the others. So check
 				// the file size first to see if this is an error we can
@@ -153,7 +458,7 @@ func (r *Receiver) merge(s *ReceiverSrcFile, rd io.ReaderAt, tmp io.Writer) erro
 				return err
 			}
 		default:
-			panic("should not happen")
+			return fmt.Errorf("unexpected block type: %v", typ)
 		}
 	}
 	// TODO: check exact file size before returning?
@@ -176,27 +481,46 @@ func (r *Receiver) merge(s *ReceiverSrcFile, rd io.ReaderAt, tmp io.Writer) erro
 	if csum := sum.Sum(nil); !bytes.Equal(csum, fileSum) {
 		got := hex.EncodeToString(csum)
 		want := hex.EncodeToString(fileSum)
-		return fmt.Errorf(
-			"checksum of file does not match the original: got: %q want %q",
-			got, want,
-		)
+		return fmt.Errorf("%w: got: %q want %q", errChecksumMismatch, got, want)
 	}
 	return nil
 }
 
 func (r *Receiver) create(s *ReceiverSrcFile) error {
-	name := filepath.Join(r.Root, s.Path)
-	dir := filepath.Dir(name)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return err
+	name, err := r.target(s.Path)
+	if err != nil {
+		return r.discard(s.Size, err)
+	}
+	// staged files are backed up as they are moved into place
+	if info, err := os.Lstat(name); err == nil && !r.Opts.DelayUpdates {
+		moved, err := r.backup(s.Path)
+		if err != nil {
+			return r.discard(s.Size, err)
+		}
+		// don't write through a symbolic link left in place of the file
+		if !moved && info.Mode()&os.ModeSymlink != 0 {
+			if err := os.Remove(name); err != nil {
+				return r.discard(s.Size, err)
+			}
+		}
 	}
 	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, s.Mode)
 	if err != nil {
-		return err
+		return r.discard(s.Size, err)
 	}
 	defer f.Close()
-	n, err := io.CopyN(f, r.Dec, s.Size)
+	w := errWriter{w: f}
+	var sw *sparseWriter
+	if r.Opts.Sparse {
+		sw = &sparseWriter{f: f}
+		w.w = sw
+	}
+	n, err := io.CopyN(&w, r.Dec, s.Size)
 	if err != nil {
+		if w.err == nil {
+			f.Close()
+			r.keepPartial(name, s.Path)
+		}
 		return err
 	}
 	if n != s.Size {
@@ -205,7 +529,28 @@ func (r *Receiver) create(s *ReceiverSrcFile) error {
 			name, n, s.Size,
 		)
 	}
-	return os.Chtimes(name, s.Mtime, s.Mtime)
+	if sw != nil && w.err == nil {
+		w.err = sw.finish()
+	}
+	if w.err != nil {
+		os.Remove(name)
+		return &fileError{w.err}
+	}
+	if err := r.chown(name, &s.SrcFile); err != nil {
+		return &fileError{err}
+	}
+	if err := r.setXattrs(name, &s.SrcFile); err != nil {
+		return &fileError{err}
+	}
+	// the mode of a new file has been masked by the umask, and the one
+	// of a truncated file is left as it was
+	if err := f.Chmod(s.Mode); err != nil {
+		return &fileError{err}
+	}
+	if err := os.Chtimes(name, s.Mtime, s.Mtime); err != nil {
+		return &fileError{err}
+	}
+	return nil
 }
 
 func doChunkFile(r io.Reader, enc Encoder, blkSize int) error {
@@ -238,20 +583,35 @@ func doChunkFile(r io.Reader, enc Encoder, blkSize int) error {
 func chunkFile(path string, enc Encoder, blockSize int) error {
 	f, err := os.Open(path)
 	if err != nil {
+		return err
 	}
 	defer f.Close()
 	return doChunkFile(f, enc, blockSize)
 }
 
+// fileSum returns the MD5 digest of the file at path.
+func fileSum(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sum := md5.New()
+	if _, err := io.Copy(sum, f); err != nil {
+		return nil, err
+	}
+	return sum.Sum(nil), nil
+}
+
 // modified during testing
 var (
-	osStat     = os.Stat
+	osStat     = os.Lstat
 	sendChunks = chunkFile
 )
 
 // TODO: Can we improve this function so that we don't need to send anything
 // back to the sender when there is no change in the directory tree?
-func SendDstFileList(root string, chunkSize int, list []ReceiverSrcFile, enc Encoder) (int, error) {
+func (r *Receiver) SendDstFileList(chunkSize int, list []ReceiverSrcFile, enc Encoder) (int, error) {
 	var nrChanged int
 	hdr := FileListHdr{
 		NumFiles: len(list),
@@ -262,69 +622,591 @@ func SendDstFileList(root string, chunkSize int, list []ReceiverSrcFile, enc Enc
 		return 0, fmt.Errorf("sending dst list header failed: %w", err)
 	}
 	for i, v := range list {
-		path := filepath.Join(root, v.Path)
+		path := filepath.Join(r.Root, v.Path)
+		if v.skipped || v.Skipped {
+			// a directory not created by MkDirs, or a file left
+			// out by the sender
+			list[i].skipped = true
+			list[i].state = DstFileIdentical
+			if err := enc.Encode(DstFile{
+				ID:   i,
+				Type: DstFileIdentical,
+			}); err != nil {
+				return nrChanged, err
+			}
+			continue
+		}
+		if !v.transferred() && !v.Mode.IsDir() {
+			// links are created by MkLinks, there is nothing
+			// the sender needs to send for them.
+			switch {
+			case v.Leader != 0:
+				list[i].state = hardLinkState(r.Root, list, &v)
+			case isDevice(v.Mode) || isSpecial(v.Mode):
+				list[i].state = specialState(path, &v.SrcFile)
+			default:
+				list[i].state = linkState(path, v.Target)
+			}
+			if r.skip(list[i].state, nil, &v.SrcFile) {
+				list[i].skipped = true
+				list[i].state = DstFileIdentical
+			}
+			if err := enc.Encode(DstFile{
+				ID:   i,
+				Type: list[i].state,
+			}); err != nil {
+				return nrChanged, err
+			}
+			continue
+		}
+		if v.Mode.IsDir() && v.state == DstFileNotExist {
+			// just created by MkDirs
+			if err := enc.Encode(DstFile{
+				ID:   i,
+				Type: DstFileNotExist,
+			}); err != nil {
+				return nrChanged, err
+			}
+			continue
+		}
 		info, err := osStat(path)
+		if err == nil && info.Mode()&os.ModeSymlink != 0 {
+			// a symbolic link is to be replaced with a regular file,
+			// or with a directory by MkDirs in dry-run mode
+			err = os.ErrNotExist
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return nrChanged, err
+		}
+		state := DstFileSimilar
 		if err != nil {
-			if os.IsNotExist(err) {
-				nrChanged++
+			state, info = DstFileNotExist, nil
+		}
+		if r.skip(state, info, &v.SrcFile) {
+			list[i].skipped = true
+			list[i].state = DstFileIdentical
+			if err := enc.Encode(DstFile{
+				ID:   i,
+				Type: DstFileIdentical,
+			}); err != nil {
+				return nrChanged, err
+			}
+			continue
+		}
+		if err == nil {
+			if v.Mode.IsDir() && !info.IsDir() {
+				// left alone by MkDirs, which has reported it
+				// as failed unless in dry-run mode
+				list[i].skipped = true
+				list[i].state = DstFileIdentical
 				if err := enc.Encode(DstFile{
 					ID:   i,
-					Type: DstFileNotExist,
+					Type: DstFileIdentical,
+				}); err != nil {
+					return nrChanged, err
+				}
+				continue
+			}
+			list[i].changes = r.changes(path, info, &v.SrcFile)
+			if info.IsDir() || r.upToDate(info, &v.SrcFile) && !r.Opts.Checksum {
+				list[i].state = DstFileIdentical
+				if err := enc.Encode(DstFile{
+					ID:      i,
+					Type:    DstFileIdentical,
+					Changes: list[i].changes,
 				}); err != nil {
 					return nrChanged, err
 				}
 				continue
 			}
-			return nrChanged, err
 		}
-		if v.Mode.IsDir() && !info.IsDir() {
-			return 0, errors.New("file type mismatch")
+		// resume an interrupted transfer from the data it has left
+		basis := path
+		if p, pinfo := r.partialFile(&list[i]); pinfo != nil {
+			if err != nil {
+				list[i].changes = r.changes(p, pinfo, &v.SrcFile)
+			}
+			basis, info, err = p, pinfo, nil
+			list[i].partial = p
 		}
-		if info.IsDir() || info.ModTime() == v.Mtime && info.Size() == v.Size {
+		if err != nil {
+			if v.transferred() {
+				nrChanged++
+			}
+			list[i].state = DstFileNotExist
 			if err := enc.Encode(DstFile{
 				ID:   i,
-				Type: DstFileIdentical,
+				Type: DstFileNotExist,
 			}); err != nil {
 				return nrChanged, err
 			}
 			continue
 		}
 		nrChanged++
-		if err := enc.Encode(DstFile{
+		list[i].state = DstFileSimilar
+		dst := DstFile{
 			ID:        i,
 			ChunkSize: chunkSize,
 			Size:      info.Size(),
 			Type:      DstFileSimilar,
-		}); err != nil {
+			Changes:   list[i].changes,
+		}
+		if r.Opts.DryRun {
+			// the sender only itemizes the changes, there are no
+			// deltas to compute the block sums for
+			dst.ChunkSize = 0
+		}
+		if r.Opts.Checksum && info.Size() == v.Size && list[i].partial == "" {
+			if dst.Sum, err = fileSum(path); err != nil {
+				return nrChanged, err
+			}
+			// the sender most likely has the same contents
+			dst.ChunkSize = 0
+			list[i].sum = dst.Sum
+		}
+		if err := enc.Encode(dst); err != nil {
 			return nrChanged, err
 		}
 		list[i].chunkSize = chunkSize
 		list[i].dstFileSize = info.Size()
-		if err := sendChunks(path, enc, chunkSize); err != nil {
+		if list[i].sum != nil || r.Opts.DryRun {
+			continue
+		}
+		if err := sendChunks(basis, enc, chunkSize); err != nil {
 			return nrChanged, err
 		}
 	}
 	return nrChanged, nil
 }
 
-// MkDirs create all the empty directories in the src file list
-func MkDirs(list []ReceiverSrcFile, root string) error {
+// SendMismatchChunks receives the outcome of the comparison of the
+// digests sent by SendDstFileList without their block sums, and sends
+// the block sums of the files that differ, along with their dst file
+// entries again.
+func (r *Receiver) SendMismatchChunks(list []ReceiverSrcFile, enc Encoder) error {
+	for i := range list {
+		v := &list[i]
+		if v.sum == nil {
+			continue
+		}
+		var desc FileDesc
+		if err := r.Dec.Decode(&desc); err != nil {
+			return fmt.Errorf("failed to recv digest comparison: %w", err)
+		}
+		if desc.ID != i {
+			return fmt.Errorf("digest comparison invalid ID got: %d, want: %d", desc.ID, i)
+		}
+		if desc.Typ == IdenticalFile {
+			continue
+		}
+		if err := enc.Encode(DstFile{
+			ID:        i,
+			ChunkSize: v.chunkSize,
+			Size:      v.dstFileSize,
+			Type:      DstFileSimilar,
+			Sum:       v.sum,
+			Changes:   v.changes,
+		}); err != nil {
+			return err
+		}
+		if err := sendChunks(filepath.Join(r.Root, v.Path), enc, v.chunkSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// skip tells whether the skip policies of the session leave the file s
+// alone, given the state of the local file, described by info if it is
+// a regular file or a directory.
+func (r *Receiver) skip(state DstFileType, info os.FileInfo, s *SrcFile) bool {
+	switch {
+	case state == DstFileNotExist:
+		return r.Opts.Existing
+	case s.Mode.IsDir():
+		return false
+	case r.Opts.IgnoreExisting:
+		return true
+	case r.Opts.Update && info != nil && info.Mode().IsRegular():
+		// newer on the receiver side
+		return info.ModTime().Sub(s.Mtime) > r.Opts.ModifyWindow
+	}
+	return false
+}
+
+// upToDate tells whether the contents of the local file described by
+// info are taken to be the same as the ones of s without looking at
+// them.
+func (r *Receiver) upToDate(info os.FileInfo, s *SrcFile) bool {
+	switch {
+	case r.Opts.IgnoreTimes:
+		return false
+	case r.Opts.SizeOnly:
+		return info.Size() == s.Size
+	}
+	return info.Size() == s.Size && sameTime(info.ModTime(), s.Mtime, r.Opts.ModifyWindow)
+}
+
+// sameTime reports whether the modification times a and b are at most
+// window apart.
+func sameTime(a, b time.Time, window time.Duration) bool {
+	d := a.Sub(b)
+	return d <= window && d >= -window
+}
+
+// changes compares the attributes of the local file at path, described
+// by info, to the ones of s.
+func (r *Receiver) changes(path string, info os.FileInfo, s *SrcFile) Changes {
+	var c Changes
+	if x, err := r.xattrChanges(path, s); err != nil {
+		// reported once they fail to be applied
+		log.Printf("failed to read the extended attributes of %s: %v", path, err)
+		c |= ChangeXattrs
+	} else {
+		c |= x
+	}
+	if s.Mode.IsRegular() && info.Size() != s.Size {
+		c |= ChangeSize
+	}
+	if !sameTime(info.ModTime(), s.Mtime, r.Opts.ModifyWindow) {
+		c |= ChangeTime
+	}
+	if info.Mode() != s.Mode {
+		c |= ChangePerms
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return c
+	}
+	if r.Opts.Owner && os.Geteuid() == 0 && int(st.Uid) != r.ids.uid(s) {
+		c |= ChangeOwner
+	}
+	if r.Opts.Group && int(st.Gid) != r.ids.gid(s) {
+		c |= ChangeGroup
+	}
+	return c
+}
+
+func linkState(path, target string) DstFileType {
+	t, err := os.Readlink(path)
+	switch {
+	case os.IsNotExist(err):
+		return DstFileNotExist
+	case err == nil && t == target:
+		return DstFileIdentical
+	}
+	return DstFileSimilar
+}
+
+// MkLinks creates the symbolic and hard links in the src file list that
+// do not exist yet, and replaces the ones that point to somewhere else.
+// Hard links are created after the files they point to have been built,
+// as building a file replaces it. The device nodes and the special files
+// are (re)created along with them. The ones that cannot be created are
+// recorded in res.
+func (r *Receiver) MkLinks(list []ReceiverSrcFile, res *Result) error {
+	if r.Opts.DryRun {
+		return nil
+	}
 	for _, v := range list {
-		if v.Mode.IsDir() {
-			if err := os.MkdirAll(filepath.Join(root, v.Path), 0755); err != nil {
-				return err
+		if v.skipped {
+			continue
+		}
+		if v.Leader != 0 {
+			r.mkHardLink(list, &v, res)
+			continue
+		}
+		special := isDevice(v.Mode) || isSpecial(v.Mode)
+		if v.Mode&os.ModeSymlink == 0 && !special || v.state == DstFileIdentical {
+			continue
+		}
+		path := filepath.Join(r.Root, v.Path)
+		mk := r.mkLink
+		if special {
+			mk = r.mkSpecial
+		}
+		if err := mk(path, &v); err != nil {
+			res.addFailure(v.Path, err)
+			continue
+		}
+		if v.state == DstFileNotExist {
+			res.Created = append(res.Created, v.Path)
+		} else {
+			res.Updated = append(res.Updated, v.Path)
+		}
+	}
+	return nil
+}
+
+// hardLinkState tells whether the hard link s already points to the
+// same file as its leader.
+func hardLinkState(root string, list []ReceiverSrcFile, s *ReceiverSrcFile) DstFileType {
+	newfi, err := os.Lstat(filepath.Join(root, s.Path))
+	if os.IsNotExist(err) {
+		return DstFileNotExist
+	}
+	if err != nil || s.Leader < 0 || s.Leader > len(list) {
+		return DstFileSimilar
+	}
+	oldfi, err := os.Lstat(filepath.Join(root, list[s.Leader-1].Path))
+	if err != nil || !os.SameFile(oldfi, newfi) {
+		return DstFileSimilar
+	}
+	return DstFileIdentical
+}
+
+func (r *Receiver) mkHardLink(list []ReceiverSrcFile, s *ReceiverSrcFile, res *Result) {
+	if s.Leader < 0 || s.Leader > len(list) {
+		res.addFailure(s.Path, fmt.Errorf("there is no such file with id: %d", s.Leader-1))
+		return
+	}
+	oldname := filepath.Join(r.Root, list[s.Leader-1].Path)
+	newname := filepath.Join(r.Root, s.Path)
+	oldfi, err := os.Lstat(oldname)
+	if err != nil {
+		res.addFailure(s.Path, err)
+		return
+	}
+	newfi, err := os.Lstat(newname)
+	exists := err == nil
+	if exists && os.SameFile(oldfi, newfi) {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(newname), 0755); err != nil {
+		res.addFailure(s.Path, err)
+		return
+	}
+	if exists {
+		if err := r.removeAll(s.Path); err != nil {
+			res.addFailure(s.Path, err)
+			return
+		}
+	}
+	if err := os.Link(oldname, newname); err != nil {
+		res.addFailure(s.Path, err)
+		return
+	}
+	if exists {
+		res.Updated = append(res.Updated, s.Path)
+	} else {
+		res.Created = append(res.Created, s.Path)
+	}
+}
+
+func (r *Receiver) mkLink(path string, s *ReceiverSrcFile) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if s.state != DstFileNotExist {
+		if err := r.removeAll(s.Path); err != nil {
+			return err
+		}
+	}
+	if err := os.Symlink(s.Target, path); err != nil {
+		return err
+	}
+	return r.chown(path, &s.SrcFile)
+}
+
+// MkDirs create all the empty directories in the src file list. The
+// directories are kept writable by their owner until FinishAttrs applies
+// their modes. The directories that cannot be created are recorded in
+// res.
+func (r *Receiver) MkDirs(list []ReceiverSrcFile, res *Result) error {
+	if r.Opts.DryRun {
+		return nil
+	}
+	for i := range list {
+		v := &list[i]
+		if !v.Mode.IsDir() {
+			continue
+		}
+		path := filepath.Join(r.Root, v.Path)
+		if err := r.mkDir(path, v); err != nil {
+			res.addFailure(v.Path, err)
+		}
+	}
+	return nil
+}
+
+func (r *Receiver) mkDir(path string, s *ReceiverSrcFile) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) && r.skip(DstFileNotExist, nil, &s.SrcFile) {
+		s.skipped = true
+		return nil
+	}
+	if err == nil && !info.IsDir() {
+		// a symbolic link is replaced with the directory, anything
+		// else is left alone, along with the files below it
+		if info.Mode()&os.ModeSymlink != 0 {
+			err = os.Remove(path)
+		} else {
+			err = syscall.ENOTDIR
+		}
+		if err != nil {
+			s.skipped = true
+			return err
+		}
+		err = os.ErrNotExist
+	}
+	if os.IsNotExist(err) {
+		if err := os.MkdirAll(path, s.Mode.Perm()|0700); err != nil {
+			return err
+		}
+		// reported as a new directory in the dst file list
+		s.state = DstFileNotExist
+	} else if err != nil {
+		return err
+	} else if info.IsDir() && info.Mode().Perm()&0700 != 0700 {
+		if err := os.Chmod(path, info.Mode()|0700); err != nil {
+			return err
+		}
+	}
+	return r.chown(path, &s.SrcFile)
+}
+
+// FinishAttrs applies the attributes of the files whose contents were
+// already up to date, and the modes and the modification times of the
+// directories in the src file list. It is called once all the files
+// have been written, deepest directories first, as creating a file in a
+// directory changes its modification time. The files that cannot be
+// updated are recorded in res.
+func (r *Receiver) FinishAttrs(list []ReceiverSrcFile, res *Result) error {
+	if r.Opts.DryRun {
+		return nil
+	}
+	var dirs []*ReceiverSrcFile
+	for i := range list {
+		v := &list[i]
+		switch {
+		case v.skipped:
+		case v.Mode.IsDir():
+			dirs = append(dirs, v)
+		case v.transferred() && v.state == DstFileIdentical && v.changes != 0:
+			if err := r.setAttrs(v); err != nil {
+				res.addFailure(v.Path, err)
 			}
 		}
 	}
+	sort.SliceStable(dirs, func(i, j int) bool {
+		return depth(dirs[i].Path) > depth(dirs[j].Path)
+	})
+	for _, v := range dirs {
+		path := filepath.Join(r.Root, v.Path)
+		info, err := os.Lstat(path)
+		if err != nil {
+			res.addFailure(v.Path, err)
+			continue
+		}
+		if !info.IsDir() {
+			// left alone by MkDirs, which has reported it as failed
+			continue
+		}
+		// before the directory is possibly made read-only
+		if err := r.setXattrs(path, &v.SrcFile); err != nil {
+			res.addFailure(v.Path, err)
+			continue
+		}
+		if info.Mode() != v.Mode {
+			if err := os.Chmod(path, v.Mode); err != nil {
+				res.addFailure(v.Path, err)
+				continue
+			}
+		}
+		if !sameTime(info.ModTime(), v.Mtime, r.Opts.ModifyWindow) {
+			if err := os.Chtimes(path, v.Mtime, v.Mtime); err != nil {
+				res.addFailure(v.Path, err)
+			}
+		}
+	}
+	return nil
+}
+
+func depth(path string) int {
+	return strings.Count(filepath.Clean(path), string(filepath.Separator))
+}
+
+// DeleteExtra removes the files under the root directory that are not
+// in the src file list and records them in res. In dry-run mode they
+// are only recorded. The files excluded by the filter rules of the
+// sender are left alone, unless the sender asks for them to be deleted
+// as well, and the ones matching the protect rules are never deleted.
+//
+// Nothing is deleted if more files than allowed by Opts.MaxDelete
+// would be deleted. Such a refusal is recorded in res as a failure of
+// the root directory.
+func (r *Receiver) DeleteExtra(list []ReceiverSrcFile, res *Result) error {
+	paths, n, err := r.extraneous(list)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return nil
+	}
+	if max := r.Opts.MaxDelete; max > 0 && n > max {
+		res.addFailure(".", fmt.Errorf("%w: %d file(s) would be deleted, the limit is %d", errMaxDelete, n, max))
+		return nil
+	}
+	for _, rel := range paths {
+		r.remove(rel, res)
+	}
 	return nil
 }
 
-func DeleteExtra(list []ReceiverSrcFile, root string) error {
+// extraneous returns the paths DeleteExtra removes, in the order they
+// are removed, and the number of files removed along with the contents
+// of the directories.
+func (r *Receiver) extraneous(list []ReceiverSrcFile) ([]string, int, error) {
+	root := r.Root
 	files := make(map[string]bool)
 	for _, m := range list {
-		files[filepath.Join(root, m.Path)] = true
+		// the parent directories are not listed unless empty
+		// directories are synced
+		for p := m.Path; p != "."; p = filepath.Dir(p) {
+			files[filepath.Join(root, p)] = true
+		}
 	}
-	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+	var (
+		filter  *Filter
+		ignores *ignoreRules
+		protect *Filter
+		err     error
+	)
+	if !r.Opts.DeleteExcluded {
+		if len(r.Opts.Filter) > 0 {
+			if filter, err = NewFilter(r.Opts.Filter); err != nil {
+				return nil, 0, err
+			}
+		}
+		if len(r.Opts.IgnoreFiles) > 0 {
+			ignores = newIgnoreRules(root, r.Opts.IgnoreFiles)
+		}
+	}
+	rules := append(r.backupRules(), r.Opts.Protect...)
+	if r.Opts.TempDir != "" {
+		rules = append(rules, Rule{Pattern: "/" + filepath.ToSlash(filepath.Clean(r.Opts.TempDir)) + "/"})
+	}
+	if r.Opts.Partial {
+		dir := r.Opts.PartialDir
+		if dir == "" {
+			dir = DefaultPartialDir
+		}
+		rules = append(rules, Rule{Pattern: "/" + filepath.ToSlash(filepath.Clean(dir)) + "/"})
+	}
+	if len(rules) > 0 {
+		if protect, err = NewFilter(rules); err != nil {
+			return nil, 0, err
+		}
+	}
+	// directories to be removed once it is known that there are no
+	// protected files in them.
+	var (
+		paths []string
+		dirs  []string
+		n     int
+	)
+	kept := make(map[string]bool)
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			if os.IsNotExist(err) {
 				return nil
@@ -337,15 +1219,78 @@ func DeleteExtra(list []ReceiverSrcFile, root string) error {
 		if n := info.Name(); n == "." || n == ".." {
 			return nil
 		}
-		if exist := files[path]; !exist {
-			err := os.RemoveAll(path)
+		if exist := files[path]; exist {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		ex, err := excluded(filter, ignores, name, info.IsDir())
+		if err != nil {
+			return err
+		}
+		if ex || protect.Excluded(name, info.IsDir()) {
+			for dir := filepath.Dir(rel); dir != "."; dir = filepath.Dir(dir) {
+				kept[dir] = true
+			}
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() && (filter != nil || ignores != nil || protect != nil) {
+			// look for the protected files in it first
+			dirs = append(dirs, rel)
+			return nil
+		}
+		paths = append(paths, rel)
+		n++
+		if info.IsDir() {
+			m, err := countFiles(path)
 			if err != nil {
-				log.Printf("RemoveAll: %v", err)
+				return err
 			}
+			n += m
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if !kept[dirs[i]] {
+			paths = append(paths, dirs[i])
+			n++
+		}
+	}
+	return paths, n, nil
+}
+
+// countFiles returns the number of files under the directory at root.
+func countFiles(root string) (int, error) {
+	n := -1
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil && !os.IsNotExist(err) {
+			return err
 		}
+		n++
 		return nil
 	})
-	return err
+	return n, err
+}
+
+func (r *Receiver) remove(rel string, res *Result) {
+	if !r.Opts.DryRun {
+		if err := r.removeAll(rel); err != nil {
+			log.Printf("RemoveAll: %v", err)
+			res.addFailure(rel, err)
+			return
+		}
+	}
+	res.Deleted = append(res.Deleted, rel)
 }
 
 func RecvSrcFileList(dec Decoder) ([]ReceiverSrcFile, bool, error) {
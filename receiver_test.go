@@ -1,8 +1,10 @@
 package psync
 
 import (
+	"bytes"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"syscall"
 	"testing"
@@ -84,7 +86,7 @@ func TestSendDstFileList(t *testing.T) {
 		}
 		return nil, os.ErrNotExist
 	}
-	defer func() { osStat = os.Stat }()
+	defer func() { osStat = os.Lstat }()
 
 	sendChunks = func(path string, enc Encoder, blockSize int) error {
 		r := ioutil.NopCloser(strings.NewReader(orig))
@@ -95,7 +97,7 @@ func TestSendDstFileList(t *testing.T) {
 		&FileListHdr{NumFiles: 3, Type: ReceiverFileList},
 		DstFile{Type: DstFileIdentical},
 		DstFile{ID: 1, Type: DstFileNotExist},
-		DstFile{ID: 2, ChunkSize: 8, Size: 57},
+		DstFile{ID: 2, ChunkSize: 8, Size: 57, Changes: ChangeTime},
 		BlockSum{Rsum: 0x071c019d, Csum: digest("2e9ec317e197819358fbc43afca7d837")},
 		BlockSum{Rsum: 0x0a3a0291, Csum: digest("0971ea36560f190d33257a3722f2b08c")},
 		BlockSum{Rsum: 0x0c1402ea, Csum: digest("6f1adba1b07b8042ab76144a2bc98f86")},
@@ -106,7 +108,8 @@ func TestSendDstFileList(t *testing.T) {
 		BlockSum{Rsum: 0x000b000b, Csum: digest("68b329da9893e34099c7d8ad5cb9c940")},
 	}
 	var enc mergeDscEnc
-	_, err := SendDstFileList("rootdir", 8, in, &enc)
+	rcv := Receiver{Root: "rootdir"}
+	_, err := rcv.SendDstFileList(8, in, &enc)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -153,3 +156,639 @@ func TestRecvSrcFileList(t *testing.T) {
 		t.Errorf("recvSrcFileList(...) mismatch (-want +got):\n%s", diff)
 	}
 }
+
+func TestDeleteExtra(t *testing.T) {
+	root, err := ioutil.TempDir("", "psync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	for _, p := range []string{"keep", "extra", "dir/keep", "dir/extra", "olddir/a"} {
+		p = filepath.Join(root, p)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list := []ReceiverSrcFile{
+		{SrcFile: SrcFile{Path: "keep"}},
+		{SrcFile: SrcFile{Path: "dir", Mode: os.ModeDir | 0755}},
+		{SrcFile: SrcFile{Path: "dir/keep"}},
+	}
+	var res Result
+	rcv := Receiver{Root: root}
+	if err := rcv.DeleteExtra(list, &res); err != nil {
+		t.Fatal(err)
+	}
+	want := Result{Deleted: []string{"dir/extra", "extra", "olddir"}}
+	if diff := cmp.Diff(want, res); diff != "" {
+		t.Errorf("DeleteExtra(...) mismatch (-want +got):\n%s", diff)
+	}
+	for _, p := range res.Deleted {
+		if _, err := os.Lstat(filepath.Join(root, p)); !os.IsNotExist(err) {
+			t.Errorf("%s has not been deleted", p)
+		}
+	}
+}
+
+func TestBuildFilesContinueOnError(t *testing.T) {
+	root, err := ioutil.TempDir("", "psync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	// nothing can be created under a regular file
+	if err := ioutil.WriteFile(filepath.Join(root, "blocker"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	list := []ReceiverSrcFile{
+		{SrcFile: SrcFile{Path: "blocker/new", Mode: 0644, Size: 5, Mtime: now}},
+		{SrcFile: SrcFile{Path: "new", Mode: 0644, Size: 5, Mtime: now}},
+		{SrcFile: SrcFile{Path: "missing", Mode: 0644, Size: 3, Mtime: now}, chunkSize: 8},
+	}
+	rcv := Receiver{
+		Root: root,
+		Dec: createFakeDecoder(
+			FileDesc{ID: 0, Typ: NewFile, TotalSize: 5},
+			[]byte("hello"),
+			FileDesc{ID: 1, Typ: NewFile, TotalSize: 5},
+			[]byte("world"),
+			FileDesc{ID: 2, Typ: PartialFile},
+			LocalBlockType,
+			LocalBlock{Size: 3},
+			[]byte("abc"),
+			RemoteBlockType,
+			RemoteBlock{ChunkID: 0, NrChunks: 1, Off: 3},
+			FileSum,
+			[]byte("0123456789abcdef"),
+		),
+	}
+	var res Result
+	if err := rcv.BuildFiles(len(list), list, &res); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"new"}, res.Created); diff != "" {
+		t.Errorf("created files mismatch (-want +got):\n%s", diff)
+	}
+	var failed []string
+	for _, f := range res.Failed {
+		failed = append(failed, f.Path)
+	}
+	if diff := cmp.Diff([]string{"blocker/new", "missing"}, failed); diff != "" {
+		t.Errorf("failed files mismatch (-want +got):\n%s", diff)
+	}
+	if code := res.Failed[1].Code; code != CodeNotExist {
+		t.Errorf("failure code = %v, want %v", code, CodeNotExist)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(root, "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "world" {
+		t.Errorf("new = %q, want %q", b, "world")
+	}
+}
+
+func TestMkLinks(t *testing.T) {
+	root, err := ioutil.TempDir("", "psync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	for name, target := range map[string]string{"same": "a", "changed": "a"} {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	list := []ReceiverSrcFile{
+		{SrcFile: SrcFile{Path: "same", Mode: os.ModeSymlink | 0777, Target: "a"}},
+		{SrcFile: SrcFile{Path: "changed", Mode: os.ModeSymlink | 0777, Target: "b"}},
+		{SrcFile: SrcFile{Path: "file", Mode: os.ModeSymlink | 0777, Target: "c"}},
+		{SrcFile: SrcFile{Path: "dir/new", Mode: os.ModeSymlink | 0777, Target: "../d"}},
+	}
+	var enc mergeDscEnc
+	rcv := Receiver{Root: root}
+	n, err := rcv.SendDstFileList(8, list, &enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("got %d changed files, want 0", n)
+	}
+	wantTypes := []DstFileType{DstFileIdentical, DstFileSimilar, DstFileSimilar, DstFileNotExist}
+	for i, v := range enc[1:] {
+		if d := v.(DstFile); d.Type != wantTypes[i] {
+			t.Errorf("%s: got %v, want %v", list[d.ID].Path, d.Type, wantTypes[i])
+		}
+	}
+	var res Result
+	if err := rcv.MkLinks(list, &res); err != nil {
+		t.Fatal(err)
+	}
+	want := Result{
+		Created: []string{"dir/new"},
+		Updated: []string{"changed", "file"},
+	}
+	if diff := cmp.Diff(want, res); diff != "" {
+		t.Errorf("MkLinks(...) mismatch (-want +got):\n%s", diff)
+	}
+	for _, v := range list {
+		target, err := os.Readlink(filepath.Join(root, v.Path))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if target != v.Target {
+			t.Errorf("%s -> %s, want %s", v.Path, target, v.Target)
+		}
+	}
+}
+
+func TestMkDirsTypeMismatch(t *testing.T) {
+	root, err := ioutil.TempDir("", "psync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err := os.Mkdir(filepath.Join(root, "elsewhere"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("elsewhere", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	list := []ReceiverSrcFile{
+		{SrcFile: SrcFile{Path: "link", Mode: os.ModeDir | 0755}},
+		{SrcFile: SrcFile{Path: "file", Mode: os.ModeDir | 0755}},
+	}
+	rcv := Receiver{Root: root}
+	var res Result
+	if err := rcv.MkDirs(list, &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Failed) != 1 || res.Failed[0].Path != "file" {
+		t.Errorf("failed files = %v, want file", res.Failed)
+	}
+	info, err := os.Lstat(filepath.Join(root, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsDir() {
+		t.Errorf("link has not been replaced with a directory: %v", info.Mode())
+	}
+	var enc mergeDscEnc
+	if _, err := rcv.SendDstFileList(8, list, &enc); err != nil {
+		t.Fatal(err)
+	}
+	wantTypes := []DstFileType{DstFileNotExist, DstFileIdentical}
+	for i, v := range enc[1:] {
+		if d := v.(DstFile); d.Type != wantTypes[i] {
+			t.Errorf("%s: got %v, want %v", list[d.ID].Path, d.Type, wantTypes[i])
+		}
+	}
+}
+
+func TestMkHardLinks(t *testing.T) {
+	root, err := ioutil.TempDir("", "psync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	for _, p := range []string{"a", "stale"} {
+		if err := ioutil.WriteFile(filepath.Join(root, p), []byte(p), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Link(filepath.Join(root, "a"), filepath.Join(root, "same")); err != nil {
+		t.Fatal(err)
+	}
+	list := []ReceiverSrcFile{
+		{SrcFile: SrcFile{Path: "a", Mode: 0644}},
+		{SrcFile: SrcFile{Path: "same", Mode: 0644, Leader: 1}},
+		{SrcFile: SrcFile{Path: "stale", Mode: 0644, Leader: 1}},
+		{SrcFile: SrcFile{Path: "dir/new", Mode: 0644, Leader: 1}},
+		{SrcFile: SrcFile{Path: "bogus", Mode: 0644, Leader: 9}},
+	}
+	rcv := Receiver{Root: root}
+	var res Result
+	if err := rcv.MkLinks(list, &res); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"dir/new"}, res.Created); diff != "" {
+		t.Errorf("created files mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"stale"}, res.Updated); diff != "" {
+		t.Errorf("updated files mismatch (-want +got):\n%s", diff)
+	}
+	if len(res.Failed) != 1 || res.Failed[0].Path != "bogus" {
+		t.Errorf("failed files = %v, want bogus", res.Failed)
+	}
+	a, err := os.Stat(filepath.Join(root, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"same", "stale", "dir/new"} {
+		fi, err := os.Stat(filepath.Join(root, p))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if !os.SameFile(a, fi) {
+			t.Errorf("%s is not a hard link to a", p)
+		}
+	}
+}
+
+func TestFinishAttrs(t *testing.T) {
+	root, err := ioutil.TempDir("", "psync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	list := []ReceiverSrcFile{
+		{SrcFile: SrcFile{Path: "a", Mode: os.ModeDir | 0500, Mtime: mtime}},
+		{SrcFile: SrcFile{Path: "a/b", Mode: os.ModeDir | 0750, Mtime: mtime.Add(time.Hour)}},
+	}
+	rcv := Receiver{Root: root}
+	var res Result
+	if err := rcv.MkDirs(list, &res); err != nil {
+		t.Fatal(err)
+	}
+	// the directories must still be writable at this point
+	if err := ioutil.WriteFile(filepath.Join(root, "a/b/f"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := rcv.FinishAttrs(list, &res); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(filepath.Join(root, "a"), 0755)
+	if len(res.Failed) != 0 {
+		t.Fatalf("failed files: %v", res.Failed)
+	}
+	for _, v := range list {
+		info, err := os.Stat(filepath.Join(root, v.Path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode() != v.Mode {
+			t.Errorf("%s: mode = %v, want %v", v.Path, info.Mode(), v.Mode)
+		}
+		if !info.ModTime().Equal(v.Mtime) {
+			t.Errorf("%s: mtime = %v, want %v", v.Path, info.ModTime(), v.Mtime)
+		}
+	}
+}
+
+func TestSendDstFileListChecksum(t *testing.T) {
+	root, err := ioutil.TempDir("", "psync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, p := range []string{"same", "grown"} {
+		p = filepath.Join(root, p)
+		if err := ioutil.WriteFile(p, []byte("abcd"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list := []ReceiverSrcFile{
+		{SrcFile: SrcFile{Path: "same", Mode: 0644, Size: 4, Mtime: mtime}},
+		{SrcFile: SrcFile{Path: "grown", Mode: 0644, Size: 5, Mtime: mtime}},
+	}
+	defer func() { sendChunks = chunkFile }()
+	sendChunks = func(path string, enc Encoder, blockSize int) error { return nil }
+	var enc mergeDscEnc
+	rcv := Receiver{Root: root, Opts: Options{Checksum: true}}
+	n, err := rcv.SendDstFileList(8, list, &enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("got %d changed files, want 2", n)
+	}
+	want := mergeDscEnc{
+		&FileListHdr{NumFiles: 2, Type: ReceiverFileList},
+		DstFile{
+			ID:   0,
+			Size: 4,
+			Sum:  digest(t, "e2fc714c4727ee9395f324cd2e7f331f"),
+		},
+		DstFile{ID: 1, ChunkSize: 8, Size: 4, Changes: ChangeSize},
+	}
+	if diff := cmp.Diff(want, enc); diff != "" {
+		t.Errorf("SendDstFileList(...) mismatch (-want +got):\n%s", diff)
+	}
+}
+
+// TestSendMismatchChunks runs the checksum mode exchange, in which the
+// block sums are only sent for the files whose digests differ.
+func TestSendMismatchChunks(t *testing.T) {
+	root, err := ioutil.TempDir("", "psync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	src, dst := filepath.Join(root, "src"), filepath.Join(root, "dst")
+	files := map[string][2]string{
+		"same":    {"abcdefghijklmnop", "abcdefghijklmnop"},
+		"changed": {"abcdefghijklmnop", "abcdefghijklmnoP"},
+	}
+	for p, c := range files {
+		for i, dir := range []string{src, dst} {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(dir, p), []byte(c[i]), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	rlist := []ReceiverSrcFile{
+		{SrcFile: SrcFile{Path: "same", Mode: 0644, Size: 16}},
+		{SrcFile: SrcFile{Path: "changed", Mode: 0644, Size: 16}},
+	}
+	slist := []SenderSrcFile{{SrcFile: rlist[0].SrcFile}, {SrcFile: rlist[1].SrcFile}}
+	rcv := Receiver{Root: dst, Opts: Options{Checksum: true}}
+
+	var dsts, matches, chunks bytes.Buffer
+	if _, err := rcv.SendDstFileList(4, rlist, newBinaryEncoder(&dsts)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RecvDstFileList(newBinaryDecoder(&dsts), slist); err != nil {
+		t.Fatal(err)
+	}
+	for i := range slist {
+		if d := &slist[i].dst; d.Sum == nil || len(d.sums) != 0 {
+			t.Errorf("%s: got %d block sums along with the digest, want none", slist[i].Path, len(d.sums))
+		}
+	}
+	s := Sender{Enc: newBinaryEncoder(&matches), Root: src}
+	if err := s.SendSumMatches(slist); err != nil {
+		t.Fatal(err)
+	}
+	rcv.Dec = newBinaryDecoder(&matches)
+	if err := rcv.SendMismatchChunks(rlist, newBinaryEncoder(&chunks)); err != nil {
+		t.Fatal(err)
+	}
+	if err := RecvMismatchChunks(newBinaryDecoder(&chunks), slist); err != nil {
+		t.Fatal(err)
+	}
+	if d := &slist[0].dst; !d.sumMatch || len(d.sums) != 0 {
+		t.Errorf("same: sumMatch = %t, got %d block sums, want a match and none", d.sumMatch, len(d.sums))
+	}
+	if d := &slist[1].dst; d.sumMatch || d.ChunkSize != 4 || len(d.sums) != 4 {
+		t.Errorf("changed: sumMatch = %t, got %d block sums of %d bytes, want 4 of 4 bytes", d.sumMatch, len(d.sums), d.ChunkSize)
+	}
+}
+
+func TestSendDstFileListSkip(t *testing.T) {
+	root, err := ioutil.TempDir("", "psync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for p, d := range map[string]time.Duration{"same": 0, "older": -time.Hour, "newer": time.Hour, "coarse": 0} {
+		p = filepath.Join(root, p)
+		if err := ioutil.WriteFile(p, []byte("abcd"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, mtime.Add(d), mtime.Add(d)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func() { sendChunks = chunkFile }()
+	sendChunks = func(path string, enc Encoder, blockSize int) error { return nil }
+	const (
+		S = DstFileSimilar
+		I = DstFileIdentical
+		N = DstFileNotExist
+	)
+	tests := []struct {
+		opts Options
+		want []DstFileType
+	}{
+		{Options{}, []DstFileType{I, S, S, S, N, I}},
+		{Options{SizeOnly: true}, []DstFileType{I, I, I, I, N, I}},
+		{Options{IgnoreTimes: true}, []DstFileType{S, S, S, S, N, I}},
+		{Options{Update: true}, []DstFileType{I, S, I, S, N, I}},
+		{Options{IgnoreExisting: true}, []DstFileType{I, I, I, I, N, I}},
+		{Options{Existing: true}, []DstFileType{I, S, S, S, I, I}},
+		{Options{ModifyWindow: time.Second}, []DstFileType{I, S, S, I, N, I}},
+	}
+	for _, tt := range tests {
+		list := []ReceiverSrcFile{
+			{SrcFile: SrcFile{Path: "same", Mode: 0644, Size: 4, Mtime: mtime}},
+			{SrcFile: SrcFile{Path: "older", Mode: 0644, Size: 4, Mtime: mtime}},
+			{SrcFile: SrcFile{Path: "newer", Mode: 0644, Size: 4, Mtime: mtime}},
+			{SrcFile: SrcFile{Path: "coarse", Mode: 0644, Size: 4, Mtime: mtime.Add(500 * time.Millisecond)}},
+			{SrcFile: SrcFile{Path: "new", Mode: 0644, Size: 4, Mtime: mtime}},
+			{SrcFile: SrcFile{Path: "huge", Mode: 0644, Size: 1 << 40, Mtime: mtime, Skipped: true}},
+		}
+		var enc mergeDscEnc
+		rcv := Receiver{Root: root, Opts: tt.opts}
+		if _, err := rcv.SendDstFileList(8, list, &enc); err != nil {
+			t.Fatal(err)
+		}
+		var got []DstFileType
+		for _, e := range enc[1:] {
+			got = append(got, e.(DstFile).Type)
+		}
+		if diff := cmp.Diff(tt.want, got); diff != "" {
+			t.Errorf("%+v: SendDstFileList(...) mismatch (-want +got):\n%s", tt.opts, diff)
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	root, err := ioutil.TempDir("", "psync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	for _, p := range []string{"extra", "file"} {
+		if err := ioutil.WriteFile(filepath.Join(root, p), []byte("abcd"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	list := []ReceiverSrcFile{
+		{SrcFile: SrcFile{Path: "dir", Mode: os.ModeDir | 0755}},
+		{SrcFile: SrcFile{Path: "link", Mode: os.ModeSymlink | 0777, Target: "dir"}},
+		{SrcFile: SrcFile{Path: "file", Mode: 0644, Size: 5, Mtime: mtime}},
+	}
+	defer func() { sendChunks = chunkFile }()
+	sendChunks = func(path string, enc Encoder, blockSize int) error {
+		t.Errorf("block sums of %s sent in dry-run mode", path)
+		return nil
+	}
+	rcv := Receiver{Root: root, Opts: Options{DryRun: true}}
+	var res Result
+	if err := rcv.DeleteExtra(list, &res); err != nil {
+		t.Fatal(err)
+	}
+	if err := rcv.MkDirs(list, &res); err != nil {
+		t.Fatal(err)
+	}
+	var enc mergeDscEnc
+	n, err := rcv.SendDstFileList(8, list, &enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("got %d changed files, want 1", n)
+	}
+	if err := rcv.MkLinks(list, &res); err != nil {
+		t.Fatal(err)
+	}
+	if err := rcv.FinishAttrs(list, &res); err != nil {
+		t.Fatal(err)
+	}
+	want := mergeDscEnc{
+		&FileListHdr{NumFiles: 3, Type: ReceiverFileList},
+		DstFile{ID: 0, Type: DstFileNotExist},
+		DstFile{ID: 1, Type: DstFileNotExist},
+		DstFile{ID: 2, Size: 4, Type: DstFileSimilar, Changes: ChangeSize | ChangeTime},
+	}
+	if diff := cmp.Diff(want, enc); diff != "" {
+		t.Errorf("SendDstFileList(...) mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(Result{Deleted: []string{"extra"}}, res); diff != "" {
+		t.Errorf("result mismatch (-want +got):\n%s", diff)
+	}
+	fis, err := ioutil.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != 2 || fis[0].Name() != "extra" || fis[1].Name() != "file" {
+		t.Errorf("destination has been modified in dry-run mode: %v", fis)
+	}
+}
+
+func TestDeleteExtraExcluded(t *testing.T) {
+	root, err := ioutil.TempDir("", "psync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	for _, p := range []string{"x.o", "extra", "old/a.o", "old/b", "gone/c"} {
+		p = filepath.Join(root, p)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list := []ReceiverSrcFile{{SrcFile: SrcFile{Path: "main.c"}}}
+	rcv := Receiver{Root: root, Opts: Options{Filter: []Rule{{Pattern: "*.o"}}}}
+	var res Result
+	if err := rcv.DeleteExtra(list, &res); err != nil {
+		t.Fatal(err)
+	}
+	want := Result{Deleted: []string{"extra", "gone/c", "old/b", "gone"}}
+	if diff := cmp.Diff(want, res); diff != "" {
+		t.Errorf("DeleteExtra(...) mismatch (-want +got):\n%s", diff)
+	}
+	for _, p := range []string{"x.o", "old/a.o"} {
+		if _, err := os.Lstat(filepath.Join(root, p)); err != nil {
+			t.Errorf("protected file %s: %v", p, err)
+		}
+	}
+}
+
+func TestDeleteExtraIgnored(t *testing.T) {
+	root, err := ioutil.TempDir("", "psync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	files := map[string]string{
+		IgnoreFile:    "*.o\n",
+		"x.o":         "",
+		"extra":       "",
+		"old/a.o":     "",
+		"old/b":       "",
+		"gone/c":      "",
+		GitIgnoreFile: "extra\n",
+	}
+	for p, data := range files {
+		p = filepath.Join(root, p)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list := []ReceiverSrcFile{{SrcFile: SrcFile{Path: IgnoreFile, Mode: 0644}}}
+	rcv := Receiver{Root: root, Opts: Options{IgnoreFiles: []string{IgnoreFile}}}
+	var res Result
+	if err := rcv.DeleteExtra(list, &res); err != nil {
+		t.Fatal(err)
+	}
+	want := Result{Deleted: []string{GitIgnoreFile, "extra", "gone/c", "old/b", "gone"}}
+	if diff := cmp.Diff(want, res); diff != "" {
+		t.Errorf("DeleteExtra(...) mismatch (-want +got):\n%s", diff)
+	}
+	for _, p := range []string{"x.o", "old/a.o"} {
+		if _, err := os.Lstat(filepath.Join(root, p)); err != nil {
+			t.Errorf("protected file %s: %v", p, err)
+		}
+	}
+}
+
+func TestDeleteExtraRefused(t *testing.T) {
+	root, err := ioutil.TempDir("", "psync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	for _, p := range []string{"a/b/keep", "extra", "olddir/x", "olddir/y"} {
+		p = filepath.Join(root, p)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// empty directories are not synced, so the parents of a/b/keep
+	// are not listed
+	list := []ReceiverSrcFile{{SrcFile: SrcFile{Path: "a/b/keep"}}}
+	var res Result
+	rcv := Receiver{Root: root, Opts: Options{MaxDelete: 3}}
+	if err := rcv.DeleteExtra(list, &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Deleted) != 0 || len(res.Failed) != 1 || res.Failed[0].Code != CodeDeleteRefused {
+		t.Errorf("DeleteExtra(...) = %+v, want a %v failure", res, CodeDeleteRefused)
+	}
+	res = Result{}
+	rcv = Receiver{Root: root, Opts: Options{MaxDelete: 4, Protect: []Rule{{Pattern: "/olddir/y"}}}}
+	if err := rcv.DeleteExtra(list, &res); err != nil {
+		t.Fatal(err)
+	}
+	want := Result{Deleted: []string{"extra", "olddir/x"}}
+	if diff := cmp.Diff(want, res); diff != "" {
+		t.Errorf("DeleteExtra(...) mismatch (-want +got):\n%s", diff)
+	}
+	for _, p := range []string{"a/b/keep", "olddir/y"} {
+		if _, err := os.Lstat(filepath.Join(root, p)); err != nil {
+			t.Errorf("%s: %v", p, err)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package psync
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// ErrorCode classifies the reason why a file could not be synced.
+type ErrorCode byte
+
+const (
+	CodeUnknown ErrorCode = iota
+	CodePermission
+	CodeNotExist
+	CodeNoSpace
+	CodeChecksum
+
+	// CodeDeleteRefused is reported for the root directory when the
+	// receiver refuses to delete the extraneous files.
+	CodeDeleteRefused
+)
+
+var (
+	errChecksumMismatch = errors.New("checksum of file does not match the original")
+	errMaxDelete        = errors.New("deletions stopped due to the max-delete limit")
+)
+
+func errorCode(err error) ErrorCode {
+	switch {
+	case errors.Is(err, os.ErrPermission):
+		return CodePermission
+	case errors.Is(err, os.ErrNotExist):
+		return CodeNotExist
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT):
+		return CodeNoSpace
+	case errors.Is(err, errChecksumMismatch):
+		return CodeChecksum
+	case errors.Is(err, errMaxDelete):
+		return CodeDeleteRefused
+	}
+	return CodeUnknown
+}
+
+// FileError describes a file the receiver failed to sync.
+type FileError struct {
+	Path string
+	Code ErrorCode
+	Err  string
+}
+
+func (e *FileError) Error() string { return e.Path + ": " + e.Err }
+
+// Result is sent back to the sender at the end of every sync. It lists
+// the paths, relative to the root directory, the receiver has created,
+// updated and deleted, as well as the ones it failed to sync.
+type Result struct {
+	Created []string
+	Updated []string
+	Deleted []string
+	Failed  []FileError
+
+	// More is set on every part but the last one of a result split up
+	// by SendResult.
+	More bool
+}
+
+// maxResultPart bounds the size of the paths and the error messages
+// sent in a single part of a result, well below the frame size limit.
+const maxResultPart = 1 << 20
+
+// SendResult sends res to the sender, split up into parts of at most
+// about maxResultPart bytes.
+func SendResult(enc Encoder, res *Result) error {
+	part := Result{More: true}
+	var size int
+	// next sends part if n more bytes would not fit in it.
+	next := func(n int) error {
+		if size > 0 && size+n > maxResultPart {
+			if err := enc.Encode(&part); err != nil {
+				return err
+			}
+			part, size = Result{More: true}, 0
+		}
+		size += n
+		return nil
+	}
+	for _, p := range res.Created {
+		if err := next(len(p)); err != nil {
+			return err
+		}
+		part.Created = append(part.Created, p)
+	}
+	for _, p := range res.Updated {
+		if err := next(len(p)); err != nil {
+			return err
+		}
+		part.Updated = append(part.Updated, p)
+	}
+	for _, p := range res.Deleted {
+		if err := next(len(p)); err != nil {
+			return err
+		}
+		part.Deleted = append(part.Deleted, p)
+	}
+	for _, f := range res.Failed {
+		if err := next(len(f.Path) + len(f.Err)); err != nil {
+			return err
+		}
+		part.Failed = append(part.Failed, f)
+	}
+	part.More = false
+	return enc.Encode(&part)
+}
+
+// RecvResult receives the result of a sync, putting its parts back
+// together.
+func RecvResult(dec Decoder, res *Result) error {
+	for {
+		var part Result
+		if err := dec.Decode(&part); err != nil {
+			return err
+		}
+		res.Created = append(res.Created, part.Created...)
+		res.Updated = append(res.Updated, part.Updated...)
+		res.Deleted = append(res.Deleted, part.Deleted...)
+		res.Failed = append(res.Failed, part.Failed...)
+		if !part.More {
+			return nil
+		}
+	}
+}
+
+func (r *Result) addFailure(path string, err error) {
+	r.Failed = append(r.Failed, FileError{
+		Path: path,
+		Code: errorCode(err),
+		Err:  err.Error(),
+	})
+}
+
+// Err returns an error summarizing the failed files, or nil if all the
+// files have been synced successfully.
+func (r *Result) Err() error {
+	if len(r.Failed) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d file(s) failed to sync", len(r.Failed))
+}
@@ -5,8 +5,11 @@ import (
 	"crypto/md5"
 	"fmt"
 	"io"
+	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
 	"syscall"
 
 	"github.com/chmduquesne/rollinghash/adler32"
@@ -34,17 +37,28 @@ type SenderDstFile struct {
 
 	// map key is adler32 hash of block
 	sums map[uint32]SenderBlockSum // used by sender
+
+	// result of comparing Sum to the digest of the source file,
+	// cached as it takes reading the whole file.
+	sumDone, sumMatch bool
 }
 
 type Sender struct {
 	Enc  EncodeWriter
 	Root string
+
+	// Inplace must be set if the receiver rebuilds the files over its
+	// own copies, so that no block is reused after it is overwritten.
+	Inplace bool
+
+	// Stats accumulates the amount of file data sent and reused.
+	Stats Stats
 }
 
 func (s *Sender) SendBlockDescList(files []SenderSrcFile) error {
 	for i := range files {
 		sf := &files[i]
-		if sf.dst.Type != DstFileIdentical && !sf.Mode.IsDir() {
+		if sf.dst.Type != DstFileIdentical && sf.transferred() {
 			err := s.sendOneBlockDesc(i, sf)
 			if err != nil {
 				return err
@@ -62,7 +76,194 @@ func (s *Sender) sendOneBlockDesc(id int, e *SenderSrcFile) error {
 		return err
 	}
 	defer f.Close()
-	return sendBlockDescs(f, id, e, s.Enc)
+	if e.dst.Sum != nil {
+		if !e.dst.sumDone {
+			if err := compareSum(f, &e.dst); err != nil {
+				return err
+			}
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		}
+		if e.dst.sumMatch {
+			return s.Enc.Encode(FileDesc{ID: id, Typ: IdenticalFile})
+		}
+	}
+	return sendBlockDescs(f, id, e, s.Enc, &s.Stats, s.Inplace)
+}
+
+// compareSum compares the MD5 digest of r's contents to the one of the
+// dst file.
+func compareSum(r io.Reader, dst *SenderDstFile) error {
+	h := md5.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return err
+	}
+	dst.sumDone = true
+	dst.sumMatch = bytes.Equal(h.Sum(nil), dst.Sum)
+	return nil
+}
+
+// Action is what a sync does, or would do in dry-run mode, to a file
+// on the receiver side.
+type Action byte
+
+const (
+	ActionNone   Action = iota
+	ActionCreate        // new file
+	ActionUpdate        // delta-update of the contents
+	ActionAttrs         // metadata-only update
+	ActionDelete
+	ActionSkip // left out by the size limits
+)
+
+// Item describes the action taken on a single file.
+type Item struct {
+	Path    string
+	Mode    os.FileMode
+	Action  Action
+	Changes Changes
+
+	// Target is the target of a symbolic link, or the path of the
+	// file a hard link points to.
+	Target   string
+	HardLink bool
+}
+
+// String formats the item the way rsync itemizes changes, i.e. as
+// YXcstpoguax followed by the path.
+func (it *Item) String() string {
+	switch it.Action {
+	case ActionDelete:
+		return "*deleting   " + it.Path
+	case ActionSkip:
+		return "*skipping   " + it.Path
+	}
+	b := []byte("...........")
+	switch {
+	case it.HardLink:
+		b[0] = 'h'
+	case it.Action == ActionAttrs:
+		b[0] = '.'
+	case it.Mode.IsRegular():
+		b[0] = '<'
+	default:
+		b[0] = 'c'
+	}
+	switch {
+	case it.Mode.IsDir():
+		b[1] = 'd'
+	case it.Mode&os.ModeSymlink != 0:
+		b[1] = 'L'
+	case it.Mode&os.ModeDevice != 0:
+		b[1] = 'D'
+	case it.Mode.IsRegular():
+		b[1] = 'f'
+	default:
+		b[1] = 'S'
+	}
+	if it.Action == ActionCreate {
+		copy(b[2:], "+++++++++")
+	} else {
+		for i, c := range []struct {
+			flag Changes
+			ch   byte
+		}{
+			{ChangeChecksum, 'c'},
+			{ChangeSize, 's'},
+			{ChangeTime, 't'},
+			{ChangePerms, 'p'},
+			{ChangeOwner, 'o'},
+			{ChangeGroup, 'g'},
+			{0, 'u'}, // access times are not preserved
+			{ChangeACL, 'a'},
+			{ChangeXattrs, 'x'},
+		} {
+			if it.Changes&c.flag != 0 {
+				b[2+i] = c.ch
+			}
+		}
+	}
+	s := string(b) + " " + it.Path
+	if it.Mode.IsDir() {
+		s += "/"
+	}
+	switch {
+	case it.HardLink:
+		s += " => " + it.Target
+	case it.Target != "":
+		s += " -> " + it.Target
+	}
+	return s
+}
+
+// Itemize tells what the receiver is going to do with each of the files
+// in the list, based on the dst file list received from it. Deletions
+// are only known by the receiver and reported in Result.Deleted.
+func (s *Sender) Itemize(files []SenderSrcFile) ([]Item, error) {
+	var items []Item
+	for i := range files {
+		sf := &files[i]
+		it := Item{
+			Path:    sf.Path,
+			Mode:    sf.Mode,
+			Changes: sf.dst.Changes,
+			Target:  sf.Target,
+		}
+		if sf.Leader > 0 && sf.Leader <= len(files) {
+			leader := &files[sf.Leader-1]
+			it.HardLink = true
+			it.Target = leader.Path
+			// rebuilding the leader, which comes first in the
+			// list, breaks its links
+			if sf.dst.Type == DstFileIdentical &&
+				leader.dst.Type != DstFileIdentical && !leader.dst.sumMatch {
+				it.Action = ActionUpdate
+			}
+		}
+		if sf.Skipped {
+			it.Action = ActionSkip
+			items = append(items, it)
+			continue
+		}
+		switch sf.dst.Type {
+		case DstFileNotExist:
+			it.Action = ActionCreate
+		case DstFileSimilar:
+			it.Action = ActionUpdate
+			if sf.Mode&os.ModeSymlink != 0 {
+				it.Changes |= ChangeChecksum
+			}
+			if sf.dst.Sum != nil {
+				if err := s.compareSum(sf); err != nil {
+					return nil, err
+				}
+				if sf.dst.sumMatch {
+					it.Action = ActionNone
+				} else {
+					it.Changes |= ChangeChecksum
+				}
+			}
+		}
+		// up to date files may still have their attributes updated
+		if it.Action == ActionNone && it.Changes != 0 {
+			it.Action = ActionAttrs
+		}
+		items = append(items, it)
+	}
+	return items, nil
+}
+
+func (s *Sender) compareSum(sf *SenderSrcFile) error {
+	if sf.dst.sumDone {
+		return nil
+	}
+	f, err := os.Open(filepath.Join(s.Root, sf.Path))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return compareSum(f, &sf.dst)
 }
 
 //
@@ -70,13 +271,14 @@ func (s *Sender) sendOneBlockDesc(id int, e *SenderSrcFile) error {
 //         |       0     1
 // TODO: calc merge offsets, coalesce concecutive blocks into single
 // merge descriptor.
-func sendBlockDescs(r io.Reader, id int, e *SenderSrcFile, enc EncodeWriter) error {
+func sendBlockDescs(r io.Reader, id int, e *SenderSrcFile, enc EncodeWriter, st *Stats, inplace bool) error {
 	if e.dst.Type == DstFileIdentical {
 		return nil
 	}
 	if e.dst.Type == DstFileNotExist {
 		enc.Encode(FileDesc{ID: id, Typ: NewFile, TotalSize: e.Size})
-		_, err := io.Copy(enc, r)
+		n, err := io.Copy(enc, r)
+		st.Literal += n
 		return err
 	}
 	chunkSize := int64(e.dst.ChunkSize)
@@ -92,6 +294,7 @@ func sendBlockDescs(r io.Reader, id int, e *SenderSrcFile, enc EncodeWriter) err
 		bsize:         chunkSize,
 		lastBlockID:   e.dst.LastChunkID(),
 		lastBlockSize: e.dst.LastChunkSize(),
+		inplace:       inplace,
 	}
 	enc.Encode(FileDesc{ID: id, Typ: PartialFile})
 Outer:
@@ -112,7 +315,7 @@ Outer:
 		if ok {
 			mh.Reset()
 			io.CopyN(mh, cr.Tail(), chunkSize)
-			if bytes.Equal(mh.Sum(nil), ch.Csum) {
+			if bytes.Equal(mh.Sum(nil), ch.Csum) && ben.reusable(ch.id) {
 				if cr.HeadLen() > 0 {
 					err = ben.sendLocalBlock()
 					if err != nil {
@@ -138,7 +341,7 @@ Outer:
 			}
 			mh.Reset()
 			io.CopyN(mh, cr.Tail(), chunkSize)
-			if bytes.Equal(mh.Sum(nil), ch.Csum) {
+			if bytes.Equal(mh.Sum(nil), ch.Csum) && ben.reusable(ch.id) {
 				// block matched, send head bytes at first
 				if cr.HeadLen() > 0 {
 					err = ben.sendLocalBlock()
@@ -156,6 +359,8 @@ Outer:
 		}
 	}
 	err = ben.flush()
+	st.Literal += ben.literal
+	st.Matched += ben.matched
 	if err != nil {
 		return err
 	}
@@ -184,6 +389,23 @@ type blockEncoder struct {
 	previousID      int
 	firstID         int
 	contiguousBsize int64
+
+	// bytes of data sent as is and reused from the receiver's copy
+	literal, matched int64
+
+	// the receiver overwrites its copy as it rebuilds the file
+	inplace bool
+}
+
+// reusable reports whether the block id of the receiver's copy can be
+// reused at the current offset. In inplace mode the blocks before the
+// current offset have already been overwritten by the receiver.
+func (d *blockEncoder) reusable(id int) bool {
+	if !d.inplace {
+		return true
+	}
+	off := d.off + d.contiguousBsize + d.r.HeadLen()
+	return int64(id)*d.bsize >= off
 }
 
 func (d *blockEncoder) findBlockSize(id int) int64 {
@@ -216,6 +438,7 @@ func (d *blockEncoder) sendLocalBlock() error {
 	var b bytes.Buffer
 	n, err := io.Copy(d.enc, io.TeeReader(d.r.Head(), &b))
 	d.off += n
+	d.literal += n
 	return err
 }
 
@@ -267,6 +490,7 @@ func (d *blockEncoder) flushReuseChunks() error {
 		Off:      d.off,
 	})
 	d.off += d.contiguousBsize
+	d.matched += d.contiguousBsize
 	d.contiguousBsize = 0
 	d.resetPrevID()
 	return err
@@ -295,23 +519,149 @@ func (d *blockEncoder) flush() error {
 	var b bytes.Buffer
 	n, err := io.Copy(d.enc, io.TeeReader(d.r.Buffered(), &b))
 	d.off += n
+	d.literal += n
 	return err
 }
 
+// SymlinkMode tells SrcFileLister what to do with symbolic links.
+type SymlinkMode byte
+
+const (
+	// SymlinkCopy sends symbolic links as links.
+	SymlinkCopy SymlinkMode = iota
+
+	// SymlinkFollow sends the files and directories symbolic links
+	// point to, as if they were in place of the links.
+	SymlinkFollow
+
+	// SymlinkSkip leaves symbolic links out of the file list.
+	SymlinkSkip
+)
+
 type SrcFileLister struct {
 	Root             string
 	IncludeEmptyDirs bool
+
+	// LookupNames makes the lister send the user and group names of
+	// the files along with their IDs.
+	LookupNames bool
+
+	Links SymlinkMode
+
+	// SafeLinks leaves the symbolic links pointing outside of Root
+	// out of the file list, when copying links as links.
+	SafeLinks bool
+
+	// HardLinks makes List send the hard links of a regular file as
+	// references to the first one listed.
+	HardLinks bool
+
+	// Filter leaves the files it excludes out of the file list, along
+	// with the contents of the excluded directories. Its rules take
+	// precedence over the ones of the ignore files.
+	Filter *Filter
+
+	// GitIgnore makes the lister read the .gitignore files along with
+	// the .psyncignore ones.
+	GitIgnore bool
+
+	// Xattrs and ACLs make the lister send the extended attributes,
+	// and the POSIX ACLs respectively, of the regular files and the
+	// directories.
+	Xattrs bool
+	ACLs   bool
+
+	// Devices and Specials make the lister send the device nodes, and
+	// the named pipes and sockets respectively, which are skipped
+	// otherwise.
+	Devices  bool
+	Specials bool
+
+	// MaxSize and MinSize, if positive, are the limits of the sizes of
+	// the regular files transferred. The files out of them are listed
+	// as skipped.
+	MaxSize int64
+	MinSize int64
+
+	// OneFileSystem keeps the lister from descending into the
+	// directories on other filesystems than the root directory. The
+	// mount points themselves are still listed.
+	OneFileSystem bool
+
+	names nameCache
+
+	// device of the root directory, reset by List.
+	rootDev *uint64
+
+	// rules of the ignore files read so far, reset by List.
+	ignores *ignoreRules
+
+	// index of the first listed path of each file with multiple
+	// hard links, plus one.
+	inodes map[devIno]int
+}
+
+type devIno struct {
+	dev, ino uint64
 }
 
 func (s *SrcFileLister) List() ([]SenderSrcFile, error) {
 	var list []SenderSrcFile
-	err := filepath.Walk(s.Root, func(path string, info os.FileInfo, err error) error {
+	s.inodes = make(map[devIno]int)
+	s.ignores = newIgnoreRules(s.Root, s.IgnoreFiles())
+	s.rootDev = nil
+	defer func() { s.inodes = nil }()
+	var walkFn filepath.WalkFunc
+	walkFn = func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return fmt.Errorf("List: %w", err)
 		}
+		if s.Links == SymlinkFollow && info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Stat(path)
+			if err != nil {
+				log.Printf("List: skipping %s: %v", path, err)
+				return nil
+			}
+			if target.IsDir() {
+				if loop, err := isLoop(path); err != nil || loop {
+					log.Printf("List: skipping symlink loop %s", path)
+					return nil
+				}
+				// a trailing slash makes Walk follow the link
+				return filepath.Walk(path+string(filepath.Separator), walkFn)
+			}
+			info = target
+		}
+		if path != s.Root {
+			rel, err := filepath.Rel(s.Root, path)
+			if err != nil {
+				return err
+			}
+			ex, err := excluded(s.Filter, s.ignores, filepath.ToSlash(rel), info.IsDir())
+			if err != nil {
+				return fmt.Errorf("List: %w", err)
+			}
+			if ex {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
 		list, err = s.addSrcFile(list, path, info)
-		return err
-	})
+		if err != nil || !info.IsDir() {
+			return err
+		}
+		other, err := s.otherFS(info)
+		if err != nil {
+			return fmt.Errorf("List: %w", err)
+		}
+		if other {
+			return filepath.SkipDir
+		}
+		return nil
+	}
+	err := filepath.Walk(s.Root, walkFn)
 	if err != nil {
 		return nil, err
 	}
@@ -319,13 +669,130 @@ func (s *SrcFileLister) List() ([]SenderSrcFile, error) {
 }
 
 func (s *SrcFileLister) AddSrcFile(list []SenderSrcFile, path string) ([]SenderSrcFile, error) {
-	info, err := os.Stat(path)
+	info, err := os.Lstat(path)
 	if err != nil {
 		return nil, err
 	}
+	if info.Mode()&os.ModeSymlink != 0 && s.Links == SymlinkFollow {
+		info, err = os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if rel, err := filepath.Rel(s.Root, path); err == nil {
+		ex, err := s.excluded(rel, info.IsDir())
+		if err != nil {
+			return list, err
+		}
+		if ex {
+			return list, nil
+		}
+		if ex, err = s.beyondMount(rel); err != nil || ex {
+			return list, err
+		}
+	}
 	return s.addSrcFile(list, path, info)
 }
 
+// otherFS reports whether the directory described by info is on
+// another filesystem than the root directory, in one-file-system mode.
+func (s *SrcFileLister) otherFS(info os.FileInfo) (bool, error) {
+	if !s.OneFileSystem {
+		return false, nil
+	}
+	if s.rootDev == nil {
+		root, err := os.Stat(s.Root)
+		if err != nil {
+			return false, err
+		}
+		dev := uint64(root.Sys().(*syscall.Stat_t).Dev)
+		s.rootDev = &dev
+	}
+	return uint64(info.Sys().(*syscall.Stat_t).Dev) != *s.rootDev, nil
+}
+
+// beyondMount reports whether the file at rel is inside a directory on
+// another filesystem than the root directory, in one-file-system mode.
+func (s *SrcFileLister) beyondMount(rel string) (bool, error) {
+	if !s.OneFileSystem {
+		return false, nil
+	}
+	for dir := filepath.Dir(rel); dir != "." && dir != ".." &&
+		!strings.HasPrefix(dir, ".."+string(filepath.Separator)); dir = filepath.Dir(dir) {
+		info, err := os.Stat(filepath.Join(s.Root, dir))
+		if err != nil {
+			return false, err
+		}
+		if other, err := s.otherFS(info); err != nil || other {
+			return other, err
+		}
+	}
+	return false, nil
+}
+
+// Excluded reports whether the file at path, or any of its parent
+// directories, is excluded by the filter or the ignore files. The
+// files which no longer exist are matched as regular files.
+func (s *SrcFileLister) Excluded(path string) (bool, error) {
+	rel, err := filepath.Rel(s.Root, path)
+	if err != nil {
+		return false, err
+	}
+	info, err := os.Lstat(path)
+	if err == nil && info.Mode()&os.ModeSymlink != 0 && s.Links == SymlinkFollow {
+		info, err = os.Stat(path)
+	}
+	return s.excluded(rel, err == nil && info.IsDir())
+}
+
+// IgnoreFiles returns the names of the ignore files read by the lister,
+// in the increasing order of precedence.
+func (s *SrcFileLister) IgnoreFiles() []string {
+	if s.GitIgnore {
+		return []string{GitIgnoreFile, IgnoreFile}
+	}
+	return []string{IgnoreFile}
+}
+
+// IsIgnoreFile reports whether the file at path is one of the ignore
+// files read by the lister. The rules read from it are dropped, so
+// that they are read again the next time they are needed.
+func (s *SrcFileLister) IsIgnoreFile(path string) bool {
+	base := filepath.Base(path)
+	for _, name := range s.IgnoreFiles() {
+		if base != name {
+			continue
+		}
+		if rel, err := filepath.Rel(s.Root, path); err == nil && s.ignores != nil {
+			s.ignores.forget(filepath.ToSlash(rel))
+		}
+		return true
+	}
+	return false
+}
+
+// excluded reports whether the file at rel, or any of its parent
+// directories, is excluded by the filter or the ignore files.
+func (s *SrcFileLister) excluded(rel string, isDir bool) (bool, error) {
+	if rel == "." {
+		return false, nil
+	}
+	if s.ignores == nil {
+		s.ignores = newIgnoreRules(s.Root, s.IgnoreFiles())
+	}
+	rel = filepath.ToSlash(rel)
+	for {
+		ex, err := excluded(s.Filter, s.ignores, rel, isDir)
+		if err != nil || ex {
+			return ex, err
+		}
+		if rel = path.Dir(rel); rel == "." {
+			return false, nil
+		}
+		isDir = true
+	}
+}
+
 func (s *SrcFileLister) addSrcFile(list []SenderSrcFile, path string, info os.FileInfo) ([]SenderSrcFile, error) {
 	size := info.Size()
 	if info.IsDir() {
@@ -345,19 +812,90 @@ func (s *SrcFileLister) addSrcFile(list []SenderSrcFile, path string, info os.Fi
 	if err != nil {
 		return list, err
 	}
-	list = append(list, SenderSrcFile{
-		SrcFile: SrcFile{
-			Path:  rel,
-			Uid:   int(info.Sys().(*syscall.Stat_t).Uid),
-			Gid:   int(info.Sys().(*syscall.Stat_t).Gid),
-			Mode:  info.Mode(),
-			Size:  size,
-			Mtime: info.ModTime(),
-		},
-	})
+	mode := info.Mode()
+	if isDevice(mode) && !s.Devices || isSpecial(mode) && !s.Specials ||
+		mode&os.ModeIrregular != 0 {
+		log.Printf("List: skipping non-regular file %s", rel)
+		return list, nil
+	}
+	sf := SrcFile{
+		Path:  rel,
+		Uid:   int(info.Sys().(*syscall.Stat_t).Uid),
+		Gid:   int(info.Sys().(*syscall.Stat_t).Gid),
+		Mode:  mode,
+		Size:  size,
+		Mtime: info.ModTime(),
+	}
+	if isDevice(mode) {
+		sf.Rdev = uint64(info.Sys().(*syscall.Stat_t).Rdev)
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		if s.Links == SymlinkSkip {
+			log.Printf("List: skipping symlink %s", rel)
+			return list, nil
+		}
+		sf.Target, err = os.Readlink(path)
+		if err != nil {
+			return list, err
+		}
+		if s.SafeLinks && !safeLink(rel, sf.Target) {
+			log.Printf("List: skipping unsafe symlink %s -> %s", rel, sf.Target)
+			return list, nil
+		}
+	}
+	if (s.Xattrs || s.ACLs) && hasXattrs(sf.Mode) {
+		sf.Xattrs, err = listXattrs(path, xattrFilter(s.Xattrs, s.ACLs))
+		if err != nil {
+			return list, err
+		}
+	}
+	if s.LookupNames {
+		sf.User = s.names.user(sf.Uid)
+		sf.Group = s.names.group(sf.Gid)
+	}
+	if mode.IsRegular() && (s.MaxSize > 0 && size > s.MaxSize || s.MinSize > 0 && size < s.MinSize) {
+		log.Printf("List: skipping %s of size %d", rel, size)
+		sf.Skipped = true
+		return append(list, SenderSrcFile{SrcFile: sf}), nil
+	}
+	// AddSrcFile is called with partial lists, so hard links are only
+	// tracked within a single List call.
+	if st := info.Sys().(*syscall.Stat_t); s.HardLinks && s.inodes != nil &&
+		info.Mode().IsRegular() && st.Nlink > 1 {
+		id := devIno{dev: uint64(st.Dev), ino: uint64(st.Ino)}
+		sf.Leader = s.inodes[id]
+		if sf.Leader == 0 {
+			s.inodes[id] = len(list) + 1
+		}
+	}
+	list = append(list, SenderSrcFile{SrcFile: sf})
 	return list, nil
 }
 
+// isLoop reports whether the symbolic link at path points to one of
+// its own parent directories.
+func isLoop(path string) (bool, error) {
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false, err
+	}
+	parent, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		return false, err
+	}
+	return parent == target || strings.HasPrefix(parent, target+string(filepath.Separator)), nil
+}
+
+// safeLink reports whether the symbolic link at path, relative to the
+// root directory, points to somewhere inside the root directory.
+func safeLink(path, target string) bool {
+	if filepath.IsAbs(target) {
+		return false
+	}
+	p := filepath.Join(filepath.Dir(path), target)
+	return p != ".." && !strings.HasPrefix(p, ".."+string(filepath.Separator))
+}
+
 // Sender protocol is more or less as described below:
 // - send the file list header (FileListHdr),
 // - send as many source files submitted in the previous item,
@@ -403,26 +941,81 @@ func RecvDstFileList(dec Decoder, list []SenderSrcFile) (int, error) {
 			return nrChanged, fmt.Errorf("dst file invalid ID got: %d, want: %d", id, i)
 		}
 		dst := &list[i].dst
-		if dst.Type != DstFileIdentical {
+		if dst.Type != DstFileIdentical && list[i].transferred() {
 			nrChanged++
 		}
-		dst.sums = make(map[uint32]SenderBlockSum)
-		nrBlocks := dst.NumChunks()
-		for j := 0; j < nrBlocks; j++ {
-			var bs SenderBlockSum
-			err := dec.Decode(&bs.BlockSum)
-			if err != nil {
-				return nrChanged, fmt.Errorf("recving block sum failed: %w", err)
-			}
-			bs.id = j
-			if _, ok := dst.sums[bs.Rsum]; ok {
-				// new := hex.EncodeToString(bs.Csum)
-				// old := hex.EncodeToString(dst.sums[bs.Rsum].Csum)
-				// return nrChanged, fmt.Errorf("duplicate block received: old: %q new: %q", old, new)
-				continue
-			}
-			dst.sums[bs.Rsum] = bs
+		if err := recvBlockSums(dec, dst); err != nil {
+			return nrChanged, err
 		}
 	}
 	return nrChanged, nil
 }
+
+func recvBlockSums(dec Decoder, dst *SenderDstFile) error {
+	dst.sums = make(map[uint32]SenderBlockSum)
+	nrBlocks := dst.NumChunks()
+	for j := 0; j < nrBlocks; j++ {
+		var bs SenderBlockSum
+		err := dec.Decode(&bs.BlockSum)
+		if err != nil {
+			return fmt.Errorf("recving block sum failed: %w", err)
+		}
+		bs.id = j
+		if _, ok := dst.sums[bs.Rsum]; ok {
+			// new := hex.EncodeToString(bs.Csum)
+			// old := hex.EncodeToString(dst.sums[bs.Rsum].Csum)
+			// return fmt.Errorf("duplicate block received: old: %q new: %q", old, new)
+			continue
+		}
+		dst.sums[bs.Rsum] = bs
+	}
+	return nil
+}
+
+// sumOnly reports whether the receiver has sent the digest of the dst
+// file without its block sums.
+func (d *SenderDstFile) sumOnly() bool { return d.Sum != nil && d.ChunkSize == 0 }
+
+// SendSumMatches tells the receiver, for each of the files it has only
+// sent the digest of, whether the digest matches the one of the source
+// file, so that it sends the block sums of the ones that do not.
+func (s *Sender) SendSumMatches(files []SenderSrcFile) error {
+	for i := range files {
+		sf := &files[i]
+		if !sf.dst.sumOnly() {
+			continue
+		}
+		if err := s.compareSum(sf); err != nil {
+			return err
+		}
+		typ := IdenticalFile
+		if !sf.dst.sumMatch {
+			typ = PartialFile
+		}
+		if err := s.Enc.Encode(FileDesc{ID: i, Typ: typ}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RecvMismatchChunks receives the dst file entries and the block sums
+// of the files SendSumMatches has reported as different.
+func RecvMismatchChunks(dec Decoder, list []SenderSrcFile) error {
+	for i := range list {
+		dst := &list[i].dst
+		if !dst.sumOnly() || dst.sumMatch {
+			continue
+		}
+		if err := dec.Decode(&dst.DstFile); err != nil {
+			return fmt.Errorf("failed to recv dst file: %w", err)
+		}
+		if dst.ID != i {
+			return fmt.Errorf("dst file invalid ID got: %d, want: %d", dst.ID, i)
+		}
+		if err := recvBlockSums(dec, dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package psync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/sys/unix"
+)
+
+func TestSrcFileListerOneFileSystem(t *testing.T) {
+	root, err := ioutil.TempDir("", "psync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	mnt := filepath.Join(root, "mnt")
+	if err := os.Mkdir(mnt, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Mount("tmpfs", mnt, "tmpfs", 0, ""); err != nil {
+		t.Skipf("cannot mount a tmpfs: %v", err)
+	}
+	defer unix.Unmount(mnt, 0)
+	for _, p := range []string{"file", "mnt/file"} {
+		if err := ioutil.WriteFile(filepath.Join(root, p), []byte(p), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lis := SrcFileLister{Root: root, IncludeEmptyDirs: true, OneFileSystem: true}
+	list, err := lis.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, sf := range list {
+		got = append(got, sf.Path)
+	}
+	if diff := cmp.Diff([]string{"file", "mnt"}, got); diff != "" {
+		t.Errorf("List() mismatch (-want +got):\n%s", diff)
+	}
+
+	list, err = lis.AddSrcFile(nil, filepath.Join(mnt, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 0 {
+		t.Errorf("AddSrcFile(...) added a file on another filesystem: %v", list)
+	}
+}
@@ -1,8 +1,14 @@
 package psync
 
 import (
+	"crypto/md5"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/chmduquesne/rollinghash/adler32"
 	"github.com/google/go-cmp/cmp"
 )
 
@@ -121,3 +127,371 @@ func TestRecvDstFileList(t *testing.T) {
 		t.Errorf("recvDstFileList(...) mismatch (-want +got):\n%s", diff)
 	}
 }
+
+func TestSrcFileListerSymlinks(t *testing.T) {
+	root, err := ioutil.TempDir("", "psync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err := os.Mkdir(filepath.Join(root, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "dir/file"), []byte("abc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"abs":      "/etc/passwd",
+		"dangle":   "missing",
+		"dirlink":  "dir",
+		"dir/esc":  "../../x",
+		"dir/loop": "..",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		lis  SrcFileLister
+		want map[string]string
+	}{
+		{
+			lis: SrcFileLister{},
+			want: map[string]string{
+				"abs":      "/etc/passwd",
+				"dangle":   "missing",
+				"dirlink":  "dir",
+				"dir/esc":  "../../x",
+				"dir/file": "",
+				"dir/loop": "..",
+			},
+		},
+		{
+			lis: SrcFileLister{SafeLinks: true},
+			want: map[string]string{
+				"dangle":   "missing",
+				"dirlink":  "dir",
+				"dir/file": "",
+				"dir/loop": "..",
+			},
+		},
+		{
+			lis:  SrcFileLister{Links: SymlinkSkip},
+			want: map[string]string{"dir/file": ""},
+		},
+		{
+			lis: SrcFileLister{Links: SymlinkFollow},
+			want: map[string]string{
+				"dir/file":     "",
+				"dirlink/file": "",
+			},
+		},
+	}
+	for i, tt := range tests {
+		tt.lis.Root = root
+		list, err := tt.lis.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]string)
+		for _, f := range list {
+			got[f.Path] = f.Target
+		}
+		// the followed /etc/passwd is a regular file
+		if tt.lis.Links == SymlinkFollow {
+			delete(got, "abs")
+		}
+		if diff := cmp.Diff(tt.want, got); diff != "" {
+			t.Errorf("%d: List() mismatch (-want +got):\n%s", i, diff)
+		}
+	}
+}
+
+func TestSrcFileListerHardLinks(t *testing.T) {
+	root, err := ioutil.TempDir("", "psync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	for _, p := range []string{"a", "b"} {
+		if err := ioutil.WriteFile(filepath.Join(root, p), []byte(p), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Link(filepath.Join(root, "a"), filepath.Join(root, "c")); err != nil {
+		t.Fatal(err)
+	}
+	lis := SrcFileLister{Root: root, HardLinks: true}
+	list, err := lis.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]int)
+	for _, f := range list {
+		got[f.Path] = f.Leader
+	}
+	want := map[string]int{"a": 0, "b": 0, "c": 1}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("List() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestSendBlockDescListChecksum(t *testing.T) {
+	root, err := ioutil.TempDir("", "psync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err := ioutil.WriteFile(filepath.Join(root, "a"), []byte("abcd"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	files := []SenderSrcFile{
+		{SrcFile: SrcFile{Path: "a", Mode: 0644, Size: 4}},
+		{SrcFile: SrcFile{Path: "a", Mode: 0644, Size: 4}},
+	}
+	files[0].dst.Sum = digest(t, "e2fc714c4727ee9395f324cd2e7f331f") // abcd
+	files[1].dst.Sum = digest(t, "d41d8cd98f00b204e9800998ecf8427e")
+	files[1].dst.ChunkSize = 8
+	var enc mergeDscEnc
+	s := Sender{Enc: &enc, Root: root}
+	if err := s.SendBlockDescList(files); err != nil {
+		t.Fatal(err)
+	}
+	if len(enc) < 2 {
+		t.Fatalf("got %d messages, want at least 2", len(enc))
+	}
+	if diff := cmp.Diff(FileDesc{ID: 0, Typ: IdenticalFile}, enc[0]); diff != "" {
+		t.Errorf("matching digest mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(FileDesc{ID: 1, Typ: PartialFile}, enc[1]); diff != "" {
+		t.Errorf("differing digest mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestItemize(t *testing.T) {
+	files := []SenderSrcFile{
+		{SrcFile: SrcFile{Path: "new"}},
+		{SrcFile: SrcFile{Path: "changed"}},
+		{SrcFile: SrcFile{Path: "same"}},
+		{SrcFile: SrcFile{Path: "chmod"}},
+		{SrcFile: SrcFile{Path: "dir", Mode: os.ModeDir | 0755}},
+	}
+	files[0].dst.Type = DstFileNotExist
+	files[1].dst.Changes = ChangeSize | ChangeTime
+	files[2].dst.Type = DstFileIdentical
+	files[3].dst = SenderDstFile{DstFile: DstFile{Type: DstFileIdentical, Changes: ChangePerms}}
+	files[4].dst = SenderDstFile{DstFile: DstFile{Type: DstFileIdentical, Changes: ChangeTime}}
+	var s Sender
+	items, err := s.Itemize(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Item{
+		{Path: "new", Action: ActionCreate},
+		{Path: "changed", Action: ActionUpdate, Changes: ChangeSize | ChangeTime},
+		{Path: "same", Action: ActionNone},
+		{Path: "chmod", Action: ActionAttrs, Changes: ChangePerms},
+		{Path: "dir", Mode: os.ModeDir | 0755, Action: ActionAttrs, Changes: ChangeTime},
+	}
+	if diff := cmp.Diff(want, items); diff != "" {
+		t.Errorf("Itemize(...) mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestItemString(t *testing.T) {
+	tests := []struct {
+		in   Item
+		want string
+	}{
+		{Item{Path: "a", Action: ActionCreate}, "<f+++++++++ a"},
+		{Item{Path: "a", Action: ActionUpdate, Changes: ChangeSize | ChangeTime}, "<f.st...... a"},
+		{Item{Path: "a", Action: ActionAttrs, Changes: ChangePerms | ChangeGroup}, ".f...p.g... a"},
+		{Item{Path: "d", Mode: os.ModeDir | 0755, Action: ActionCreate}, "cd+++++++++ d/"},
+		{Item{Path: "d", Mode: os.ModeDir | 0755, Action: ActionAttrs, Changes: ChangeACL | ChangeXattrs}, ".d.......ax d/"},
+		{
+			Item{Path: "l", Mode: os.ModeSymlink | 0777, Action: ActionUpdate, Changes: ChangeChecksum, Target: "b"},
+			"cLc........ l -> b",
+		},
+		{Item{Path: "h", Action: ActionCreate, HardLink: true, Target: "a"}, "hf+++++++++ h => a"},
+		{Item{Path: "x", Action: ActionDelete}, "*deleting   x"},
+		{Item{Path: "x", Action: ActionSkip}, "*skipping   x"},
+	}
+	for _, tt := range tests {
+		if got := tt.in.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestSendBlockDescsStats(t *testing.T) {
+	src := &SenderSrcFile{SrcFile: SrcFile{Size: 12}}
+	src.dst.Type = DstFileNotExist
+	var st Stats
+	var enc mergeDscEnc
+	if err := sendBlockDescs(strings.NewReader("abcdefghijkl"), 0, src, &enc, &st, false); err != nil {
+		t.Fatal(err)
+	}
+	// reuse the 2nd and the 3rd blocks of the receiver's copy
+	src.dst = SenderDstFile{
+		DstFile: DstFile{Type: DstFileSimilar, ChunkSize: 4, Size: 12},
+		sums:    make(map[uint32]SenderBlockSum),
+	}
+	for i, b := range []string{"efgh", "ijkl"} {
+		sum := md5.Sum([]byte(b))
+		rsum := adler32.New()
+		rsum.Write([]byte(b))
+		src.dst.sums[rsum.Sum32()] = SenderBlockSum{
+			id:       i + 1,
+			BlockSum: BlockSum{Rsum: rsum.Sum32(), Csum: sum[:]},
+		}
+	}
+	if err := sendBlockDescs(strings.NewReader("ABCDefghijkl"), 0, src, &enc, &st, false); err != nil {
+		t.Fatal(err)
+	}
+	if want := (Stats{Literal: 16, Matched: 8}); st != want {
+		t.Errorf("got %+v, want %+v", st, want)
+	}
+}
+
+func TestSrcFileListerFilter(t *testing.T) {
+	root, err := ioutil.TempDir("", "psync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	for _, p := range []string{"main.c", "main.o", "build/out", ".git/HEAD"} {
+		p = filepath.Join(root, p)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := NewFilter([]Rule{{Pattern: "*.o"}, {Pattern: "build/"}, {Pattern: "/.git/"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis := SrcFileLister{Root: root, IncludeEmptyDirs: true, Filter: f}
+	list, err := lis.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, sf := range list {
+		got = append(got, sf.Path)
+	}
+	if diff := cmp.Diff([]string{"main.c"}, got); diff != "" {
+		t.Errorf("List() mismatch (-want +got):\n%s", diff)
+	}
+	list, err = lis.AddSrcFile(nil, filepath.Join(root, "build/out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 0 {
+		t.Errorf("AddSrcFile(...) added a file in an excluded directory: %v", list)
+	}
+}
+
+func TestSrcFileListerSize(t *testing.T) {
+	root, err := ioutil.TempDir("", "psync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	for p, size := range map[string]int{"big": 1000, "lock": 0, "mid": 100} {
+		if err := ioutil.WriteFile(filepath.Join(root, p), make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lis := SrcFileLister{Root: root, MinSize: 1, MaxSize: 500}
+	list, err := lis.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]bool)
+	for _, sf := range list {
+		got[sf.Path] = sf.Skipped
+	}
+	want := map[string]bool{"big": true, "lock": true, "mid": false}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("List() skipped files mismatch (-want +got):\n%s", diff)
+	}
+	items, err := new(Sender).Itemize(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if items[0].Action != ActionSkip || items[1].Action != ActionSkip {
+		t.Errorf("Itemize(...) = %v, want the skipped files itemized as such", items)
+	}
+}
+
+func TestSrcFileListerIgnore(t *testing.T) {
+	root, err := ioutil.TempDir("", "psync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	files := map[string]string{
+		IgnoreFile:          "*.log\nbuild/\n",
+		"main.c":            "",
+		"run.log":           "",
+		"build/out":         "",
+		"sub/" + IgnoreFile: "!keep.log\n",
+		"sub/keep.log":      "",
+		"sub/other.log":     "",
+		"sub/build/out":     "",
+	}
+	for p, data := range files {
+		p = filepath.Join(root, p)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := NewFilter([]Rule{{Include: true, Pattern: "/run.log"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis := SrcFileLister{Root: root, Filter: f}
+	list, err := lis.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, sf := range list {
+		got = append(got, sf.Path)
+	}
+	want := []string{IgnoreFile, "main.c", "run.log", "sub/" + IgnoreFile, "sub/keep.log"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("List() mismatch (-want +got):\n%s", diff)
+	}
+
+	for _, p := range []string{"sub/other.log", "sub/build/out"} {
+		ex, err := lis.Excluded(filepath.Join(root, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ex {
+			t.Errorf("Excluded(%q) = false", p)
+		}
+	}
+	// a changed ignore file is read again
+	p := filepath.Join(root, "sub", IgnoreFile)
+	if err := ioutil.WriteFile(p, []byte("!*.log\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !lis.IsIgnoreFile(p) {
+		t.Fatalf("IsIgnoreFile(%q) = false", p)
+	}
+	list, err = lis.AddSrcFile(nil, filepath.Join(root, "sub/other.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 {
+		t.Errorf("AddSrcFile(...) = %v, want sub/other.log", list)
+	}
+}
@@ -0,0 +1,44 @@
+package psync
+
+import (
+	"bytes"
+	"os"
+)
+
+// sparseBlockSize is the size of the blocks, aligned to the file offset,
+// sparseWriter looks for zeros in.
+const sparseBlockSize = 4096
+
+var zeroBlock [sparseBlockSize]byte
+
+// sparseWriter writes to a new file, seeking over the zeros instead of
+// writing them, so that the blocks made of zeros only are left as holes
+// in the file. The unwritten parts of a new file read as zeros anyway.
+type sparseWriter struct {
+	f   *os.File
+	off int64
+}
+
+func (w *sparseWriter) Write(p []byte) (int, error) {
+	var n int
+	for n < len(p) {
+		// blocks are aligned to the file offset
+		k := sparseBlockSize - int(w.off%sparseBlockSize)
+		if k > len(p)-n {
+			k = len(p) - n
+		}
+		b := p[n : n+k]
+		if !bytes.Equal(b, zeroBlock[:k]) {
+			if _, err := w.f.WriteAt(b, w.off); err != nil {
+				return n, err
+			}
+		}
+		w.off += int64(k)
+		n += k
+	}
+	return n, nil
+}
+
+// finish sets the size of the file to the number of bytes written, as
+// it falls short of it if it ends with a hole.
+func (w *sparseWriter) finish() error { return w.f.Truncate(w.off) }
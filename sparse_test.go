@@ -0,0 +1,55 @@
+package psync
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestBuildFilesSparse(t *testing.T) {
+	root, err := ioutil.TempDir("", "psync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	// data surrounded with holes, the last one not block aligned
+	data := make([]byte, 64*sparseBlockSize+100)
+	copy(data[32*sparseBlockSize+10:], "hello")
+	list := []ReceiverSrcFile{
+		{SrcFile: SrcFile{Path: "disk.img", Mode: 0644, Size: int64(len(data)), Mtime: time.Now()}},
+	}
+	rcv := Receiver{
+		Root: root,
+		Opts: Options{Sparse: true},
+		Dec: createFakeDecoder(
+			FileDesc{ID: 0, Typ: NewFile, TotalSize: int64(len(data))},
+			data,
+		),
+	}
+	var res Result
+	if err := rcv.BuildFiles(1, list, &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Failed) != 0 {
+		t.Fatal(res.Failed)
+	}
+	name := filepath.Join(root, "disk.img")
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Errorf("disk.img contents mismatch")
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(name, &st); err != nil {
+		t.Fatal(err)
+	}
+	if n := st.Blocks * 512; n >= int64(len(data))/2 {
+		t.Errorf("%d bytes allocated for %d bytes of mostly zeros", n, len(data))
+	}
+}
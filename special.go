@@ -0,0 +1,65 @@
+package psync
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+var errSpecialType = errors.New("special file type not enabled")
+
+// isDevice reports whether mode is the one of a block or character
+// device node.
+func isDevice(mode os.FileMode) bool { return mode&os.ModeDevice != 0 }
+
+// isSpecial reports whether mode is the one of a named pipe or a socket.
+func isSpecial(mode os.FileMode) bool { return mode&(os.ModeNamedPipe|os.ModeSocket) != 0 }
+
+// specialType is the part of the mode telling the type of a device
+// node or a special file.
+const specialType = os.ModeDevice | os.ModeCharDevice | os.ModeNamedPipe | os.ModeSocket
+
+// specialState tells whether the device node or the special file s
+// already exists at path with the same type, permissions and device
+// number.
+func specialState(path string, s *SrcFile) DstFileType {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return DstFileNotExist
+	}
+	if err != nil || info.Mode()&(specialType|os.ModePerm) != s.Mode&(specialType|os.ModePerm) {
+		return DstFileSimilar
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && isDevice(s.Mode) && uint64(st.Rdev) != s.Rdev {
+		return DstFileSimilar
+	}
+	return DstFileIdentical
+}
+
+// mkSpecial creates the device node or the special file s at path,
+// replacing whatever is there, if the session options allow for it.
+func (r *Receiver) mkSpecial(path string, s *ReceiverSrcFile) error {
+	if isDevice(s.Mode) && !r.Opts.Devices || isSpecial(s.Mode) && !r.Opts.Specials {
+		return errSpecialType
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if s.state != DstFileNotExist {
+		if err := r.removeAll(s.Path); err != nil {
+			return err
+		}
+	}
+	if err := mknod(path, s.Mode, s.Rdev); err != nil {
+		return err
+	}
+	if err := r.chown(path, &s.SrcFile); err != nil {
+		return err
+	}
+	// the permissions have been masked by the umask
+	if err := os.Chmod(path, s.Mode); err != nil {
+		return err
+	}
+	return os.Chtimes(path, s.Mtime, s.Mtime)
+}
@@ -0,0 +1,23 @@
+package psync
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// mknod creates a device node or a special file of the given mode.
+func mknod(path string, mode os.FileMode, rdev uint64) error {
+	m := uint32(mode.Perm())
+	switch {
+	case mode&os.ModeCharDevice != 0:
+		m |= unix.S_IFCHR
+	case mode&os.ModeDevice != 0:
+		m |= unix.S_IFBLK
+	case mode&os.ModeNamedPipe != 0:
+		m |= unix.S_IFIFO
+	case mode&os.ModeSocket != 0:
+		m |= unix.S_IFSOCK
+	}
+	return unix.Mknod(path, m, int(rdev))
+}
@@ -0,0 +1,90 @@
+package psync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/sys/unix"
+)
+
+func TestSpecialFiles(t *testing.T) {
+	root, err := ioutil.TempDir("", "psync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	src, dst := filepath.Join(root, "src"), filepath.Join(root, "dst")
+	for _, dir := range []string{src, dst} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := unix.Mkfifo(filepath.Join(src, "fifo"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"fifo", "file"}
+	if os.Geteuid() == 0 {
+		if err := unix.Mknod(filepath.Join(src, "null"), unix.S_IFCHR|0666, int(unix.Mkdev(1, 3))); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, "null")
+	}
+	// listed in lexical order
+	if err := ioutil.WriteFile(filepath.Join(src, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	paths := func(files []SenderSrcFile) []string {
+		var l []string
+		for _, f := range files {
+			l = append(l, f.Path)
+		}
+		return l
+	}
+	lis := SrcFileLister{Root: src}
+	files, err := lis.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"file"}, paths(files)); diff != "" {
+		t.Errorf("List() mismatch (-want +got):\n%s", diff)
+	}
+	lis = SrcFileLister{Root: src, Devices: true, Specials: true}
+	if files, err = lis.List(); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, paths(files)); diff != "" {
+		t.Errorf("List() mismatch (-want +got):\n%s", diff)
+	}
+
+	var (
+		list    []ReceiverSrcFile
+		created []string
+	)
+	for _, f := range files {
+		if !f.Mode.IsRegular() {
+			list = append(list, ReceiverSrcFile{SrcFile: f.SrcFile})
+			created = append(created, f.Path)
+		}
+	}
+	rcv := Receiver{Root: dst, Opts: Options{Devices: true, Specials: true}}
+	var enc mergeDscEnc
+	if _, err := rcv.SendDstFileList(8, list, &enc); err != nil {
+		t.Fatal(err)
+	}
+	var res Result
+	if err := rcv.MkLinks(list, &res); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(Result{Created: created}, res); diff != "" {
+		t.Errorf("MkLinks(...) mismatch (-want +got):\n%s", diff)
+	}
+	for _, s := range list {
+		if st := specialState(filepath.Join(dst, s.Path), &s.SrcFile); st != DstFileIdentical {
+			t.Errorf("%s: state %v, want %v", s.Path, st, DstFileIdentical)
+		}
+	}
+}
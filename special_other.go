@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package psync
+
+import (
+	"errors"
+	"os"
+)
+
+var errMknod = errors.New("special files are not supported on this platform")
+
+func mknod(path string, mode os.FileMode, rdev uint64) error { return errMknod }
@@ -0,0 +1,112 @@
+package psync
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// StagingDir is the hidden directory, under the root directory, the
+// rebuilt files are staged in until the end of the transfer in
+// delay-updates mode.
+const StagingDir = ".psync-staging"
+
+var errTempDir = errors.New("temp directory must be a relative path inside the root directory")
+
+// localDir resolves dir, a path relative to the root directory given by
+// the sender, and fails with err if it is not inside the root
+// directory.
+func (r *Receiver) localDir(dir string, err error) (string, error) {
+	dir = filepath.Clean(dir)
+	if filepath.IsAbs(dir) || dir == "." || dir == ".." ||
+		strings.HasPrefix(dir, ".."+string(filepath.Separator)) {
+		return "", err
+	}
+	return filepath.Join(r.Root, dir), nil
+}
+
+// tempFile creates the temporary file the file at name is rebuilt in.
+// It is created in the temp directory if there is one, otherwise next
+// to the file, so that renaming it into place is atomic.
+func (r *Receiver) tempFile(name string) (*os.File, error) {
+	dir := filepath.Dir(name)
+	if r.Opts.TempDir != "" {
+		var err error
+		if dir, err = r.localDir(r.Opts.TempDir, errTempDir); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	return ioutil.TempFile(dir, ".psync*.tmp")
+}
+
+// target returns the path the file at rel is written to, its staged
+// copy in delay-updates mode, and creates its parent directories.
+func (r *Receiver) target(rel string) (string, error) {
+	name := filepath.Join(r.Root, rel)
+	if r.Opts.DelayUpdates {
+		name = filepath.Join(r.Root, StagingDir, rel)
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// commitStaged moves the files staged by BuildFiles into place, backing
+// up the files they replace, and removes the staging directory. The
+// files that cannot be moved are recorded in res as failed, rather than
+// created or updated.
+func (r *Receiver) commitStaged(res *Result) error {
+	failed := make(map[string]bool)
+	for _, rel := range r.staged {
+		if err := r.commit(rel); err != nil {
+			res.addFailure(rel, err)
+			failed[rel] = true
+		}
+	}
+	r.staged = nil
+	res.Created = without(res.Created, failed)
+	res.Updated = without(res.Updated, failed)
+	return os.RemoveAll(filepath.Join(r.Root, StagingDir))
+}
+
+func (r *Receiver) commit(rel string) error {
+	if _, err := r.backup(rel); err != nil {
+		return err
+	}
+	name := filepath.Join(r.Root, rel)
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	return os.Rename(filepath.Join(r.Root, StagingDir, rel), name)
+}
+
+// dropStaged removes the staged files, along with their entries in the
+// created and updated files of res, as they are not going to be moved
+// into place.
+func (r *Receiver) dropStaged(res *Result) error {
+	staged := make(map[string]bool)
+	for _, rel := range r.staged {
+		staged[rel] = true
+	}
+	r.staged = nil
+	res.Created = without(res.Created, staged)
+	res.Updated = without(res.Updated, staged)
+	return os.RemoveAll(filepath.Join(r.Root, StagingDir))
+}
+
+// without returns the paths that are not in set.
+func without(paths []string, set map[string]bool) []string {
+	var kept []string
+	for _, p := range paths {
+		if !set[p] {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,114 @@
+package psync
+
+import (
+	"crypto/md5"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestBuildFilesDelayUpdates(t *testing.T) {
+	root, err := ioutil.TempDir("", "psync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	// nothing can be created under a regular file
+	if err := ioutil.WriteFile(filepath.Join(root, "blocker"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "old"), []byte("abc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	sum := md5.Sum([]byte("helloabc"))
+	list := []ReceiverSrcFile{
+		{SrcFile: SrcFile{Path: "dir/new", Mode: 0644, Size: 5, Mtime: now}},
+		{SrcFile: SrcFile{Path: "old", Mode: 0644, Size: 8, Mtime: now}, dstFileSize: 3, chunkSize: 8},
+		{SrcFile: SrcFile{Path: "blocker/new", Mode: 0644, Size: 5, Mtime: now}},
+		{SrcFile: SrcFile{Path: "missing", Mode: 0644, Size: 3, Mtime: now}, chunkSize: 8},
+	}
+	stream := []interface{}{
+		FileDesc{ID: 0, Typ: NewFile, TotalSize: 5},
+		[]byte("hello"),
+		FileDesc{ID: 2, Typ: NewFile, TotalSize: 5},
+		[]byte("world"),
+		FileDesc{ID: 1, Typ: PartialFile},
+		LocalBlockType,
+		LocalBlock{Size: 5},
+		[]byte("hello"),
+		RemoteBlockType,
+		RemoteBlock{ChunkID: 0, NrChunks: 1, Off: 5},
+		FileSum,
+		sum[:],
+		FileDesc{ID: 3, Typ: PartialFile},
+		LocalBlockType,
+		LocalBlock{Size: 3},
+		[]byte("abc"),
+		RemoteBlockType,
+		RemoteBlock{ChunkID: 0, NrChunks: 1, Off: 3},
+		FileSum,
+		[]byte("0123456789abcdef"),
+	}
+	opts := Options{DelayUpdates: true, TempDir: "tmp"}
+
+	// a failure to build a single file leaves all the files alone
+	rcv := Receiver{Root: root, Opts: opts, Dec: createFakeDecoder(stream...)}
+	var res Result
+	if err := rcv.BuildFiles(len(list), list, &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Created) != 0 || len(res.Updated) != 0 || len(res.Failed) != 1 {
+		t.Errorf("BuildFiles(...) = %+v, want a single failure", res)
+	}
+	for name, want := range map[string]string{"dir/new": "", "old": "abc", StagingDir: ""} {
+		b, err := ioutil.ReadFile(filepath.Join(root, name))
+		if want == "" {
+			if !os.IsNotExist(err) {
+				t.Errorf("%s exists", name)
+			}
+		} else if string(b) != want {
+			t.Errorf("%s = %q, want %q", name, b, want)
+		}
+	}
+
+	// all the files are moved into place at the end, but the ones that
+	// cannot be moved
+	rcv = Receiver{Root: root, Opts: opts, Dec: createFakeDecoder(stream[:12]...)}
+	res = Result{}
+	if err := rcv.BuildFiles(3, list, &res); err != nil {
+		t.Fatal(err)
+	}
+	var failed []string
+	for _, f := range res.Failed {
+		failed = append(failed, f.Path)
+	}
+	res.Failed = nil
+	if diff := cmp.Diff([]string{"blocker/new"}, failed); diff != "" {
+		t.Errorf("failed files mismatch (-want +got):\n%s", diff)
+	}
+	want := Result{Created: []string{"dir/new"}, Updated: []string{"old"}}
+	if diff := cmp.Diff(want, res); diff != "" {
+		t.Errorf("BuildFiles(...) mismatch (-want +got):\n%s", diff)
+	}
+	for name, want := range map[string]string{"dir/new": "hello", "old": "helloabc"} {
+		b, err := ioutil.ReadFile(filepath.Join(root, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != want {
+			t.Errorf("%s = %q, want %q", name, b, want)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(root, StagingDir)); !os.IsNotExist(err) {
+		t.Errorf("staging directory has not been removed: %v", err)
+	}
+	tmp, err := ioutil.ReadDir(filepath.Join(root, "tmp"))
+	if err != nil || len(tmp) != 0 {
+		t.Errorf("temp directory: %v, %v", tmp, err)
+	}
+}
@@ -0,0 +1,55 @@
+package psync
+
+import (
+	"fmt"
+	"io"
+)
+
+// Stats are the transfer statistics of a single sync.
+type Stats struct {
+	NumFiles   int   // files in the src file list
+	NumChanged int   // files created, updated or deleted
+	TotalSize  int64 // total size of the regular files listed
+
+	// Literal is the amount of file data sent as is, and Matched is
+	// the amount of data the receiver has reused from its own copies
+	// of the files.
+	Literal, Matched int64
+
+	// FileListSize is the number of bytes sent for the src file list,
+	// and ChecksumSize is the number of bytes received for the dst
+	// file list and the block checksums.
+	FileListSize, ChecksumSize int64
+
+	// Sent and Received are the numbers of bytes sent and received
+	// on the wire, including all the above.
+	Sent, Received int64
+}
+
+// Speedup is the ratio of the total size of the files to the amount of
+// data exchanged with the receiver.
+func (s *Stats) Speedup() float64 {
+	if n := s.Sent + s.Received; n > 0 {
+		return float64(s.TotalSize) / float64(n)
+	}
+	return 0
+}
+
+// WriteTo writes the statistics in a human readable form to w.
+func (s *Stats) WriteTo(w io.Writer) (int64, error) {
+	n, err := fmt.Fprintf(w, ""+
+		"Number of files: %d\n"+
+		"Number of files changed: %d\n"+
+		"Total file size: %d bytes\n"+
+		"Literal data: %d bytes\n"+
+		"Matched data: %d bytes\n"+
+		"File list size: %d bytes\n"+
+		"Checksum size: %d bytes\n"+
+		"Total bytes sent: %d\n"+
+		"Total bytes received: %d\n"+
+		"speedup is %.2f\n",
+		s.NumFiles, s.NumChanged, s.TotalSize, s.Literal, s.Matched,
+		s.FileListSize, s.ChecksumSize, s.Sent, s.Received, s.Speedup(),
+	)
+	return int64(n), err
+}
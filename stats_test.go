@@ -0,0 +1,58 @@
+package psync
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestStatsSpeedup(t *testing.T) {
+	tests := []struct {
+		st   Stats
+		want float64
+	}{
+		{Stats{TotalSize: 1000, Sent: 40, Received: 10}, 20},
+		{Stats{TotalSize: 100, Sent: 150, Received: 50}, 0.5},
+		{Stats{TotalSize: 100}, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.st.Speedup(); got != tt.want {
+			t.Errorf("%+v: Speedup() = %v, want %v", tt.st, got, tt.want)
+		}
+	}
+}
+
+func TestStatsWriteTo(t *testing.T) {
+	st := Stats{
+		NumFiles:     12,
+		NumChanged:   3,
+		TotalSize:    4096,
+		Literal:      100,
+		Matched:      900,
+		FileListSize: 250,
+		ChecksumSize: 180,
+		Sent:         600,
+		Received:     424,
+	}
+	var b bytes.Buffer
+	n, err := st.WriteTo(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "" +
+		"Number of files: 12\n" +
+		"Number of files changed: 3\n" +
+		"Total file size: 4096 bytes\n" +
+		"Literal data: 100 bytes\n" +
+		"Matched data: 900 bytes\n" +
+		"File list size: 250 bytes\n" +
+		"Checksum size: 180 bytes\n" +
+		"Total bytes sent: 600\n" +
+		"Total bytes received: 424\n" +
+		"speedup is 4.00\n"
+	if got := b.String(); got != want {
+		t.Errorf("WriteTo(...) wrote:\n%s\nwant:\n%s", got, want)
+	}
+	if n != int64(b.Len()) {
+		t.Errorf("WriteTo(...) = %d, want %d", n, b.Len())
+	}
+}
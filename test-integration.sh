@@ -196,12 +196,10 @@ test_initial_sync() {
     log_test "Initial full synchronization"
 
     log_info "Running psync client..."
-    "$PSYNC_BIN" -addr "$SERVER_ADDR" "$CLIENT_DIR" > "${TEST_DIR}/sync1.log" 2>&1
-
-    if grep -q "recv'd ack:" "${TEST_DIR}/sync1.log"; then
-        log_success "Received server acknowledgment"
+    if "$PSYNC_BIN" -addr "$SERVER_ADDR" "$CLIENT_DIR" > "${TEST_DIR}/sync1.log" 2>&1; then
+        log_success "Received successful sync result"
     else
-        log_error "No acknowledgment received"
+        log_error "Sync reported failures"
         cat "${TEST_DIR}/sync1.log"
         return 1
     fi
@@ -243,9 +241,7 @@ test_delta_sync() {
     echo "This is new content appended to the file!" >> "$CLIENT_DIR/hello.txt"
 
     log_info "Running delta sync..."
-    "$PSYNC_BIN" -addr "$SERVER_ADDR" "$CLIENT_DIR" > "${TEST_DIR}/sync2.log" 2>&1
-
-    if grep -q "recv'd ack:" "${TEST_DIR}/sync2.log"; then
+    if "$PSYNC_BIN" -addr "$SERVER_ADDR" "$CLIENT_DIR" > "${TEST_DIR}/sync2.log" 2>&1; then
         log_success "Delta sync completed"
     else
         log_error "Delta sync failed"
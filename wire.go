@@ -0,0 +1,46 @@
+package psync
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"io"
+)
+
+type gobEncodeWriter struct {
+	io.Writer
+	*gob.Encoder
+}
+
+type gobDecodeReader struct {
+	io.Reader
+	*gob.Decoder
+}
+
+// NewEncoder returns an EncodeWriter that serializes messages into w
+// using the given wire format. Raw file data written to the returned
+// EncodeWriter goes straight to w.
+func NewEncoder(w io.Writer, wireFormat byte) (EncodeWriter, error) {
+	switch wireFormat {
+	case WireFormatGob:
+		return gobEncodeWriter{Writer: w, Encoder: gob.NewEncoder(w)}, nil
+	case WireFormatBinary:
+		return newBinaryEncoder(w), nil
+	}
+	return nil, fmt.Errorf("unsupported wire format: %d", wireFormat)
+}
+
+// NewDecoder returns a DecodeReader that deserializes messages read
+// from r using the given wire format. Both messages and raw file data
+// are read through the same buffer, so r must not be read from
+// elsewhere after this call.
+func NewDecoder(r io.Reader, wireFormat byte) (DecodeReader, error) {
+	br := bufio.NewReader(r)
+	switch wireFormat {
+	case WireFormatGob:
+		return gobDecodeReader{Reader: br, Decoder: gob.NewDecoder(br)}, nil
+	case WireFormatBinary:
+		return newBinaryDecoder(br), nil
+	}
+	return nil, fmt.Errorf("unsupported wire format: %d", wireFormat)
+}
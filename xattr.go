@@ -0,0 +1,111 @@
+package psync
+
+import (
+	"bytes"
+	"os"
+	"strings"
+)
+
+// names of the extended attributes the POSIX ACLs are stored in
+const (
+	aclAccess  = "system.posix_acl_access"
+	aclDefault = "system.posix_acl_default"
+)
+
+func isACL(name string) bool { return name == aclAccess || name == aclDefault }
+
+// xattrFilter returns a function reporting whether an extended
+// attribute is preserved, given whether the extended attributes and the
+// ACLs are. The rest of the system namespace reflects the state of the
+// filesystem, rather than of the file, and is never preserved.
+func xattrFilter(xattrs, acls bool) func(name string) bool {
+	return func(name string) bool {
+		if isACL(name) {
+			return acls
+		}
+		return xattrs && !strings.HasPrefix(name, "system.")
+	}
+}
+
+// hasXattrs reports whether the extended attributes of the files of
+// mode are preserved. Those of symbolic links and special files are
+// not.
+func hasXattrs(mode os.FileMode) bool { return mode.IsRegular() || mode.IsDir() }
+
+// wantXattr reports whether the receiver applies the extended attribute
+// called name. Only root may set the attributes outside of the user
+// namespace, besides the ACLs of the files it owns.
+func (r *Receiver) wantXattr(name string) bool {
+	if !xattrFilter(r.Opts.Xattrs, r.Opts.ACLs)(name) {
+		return false
+	}
+	return isACL(name) || strings.HasPrefix(name, "user.") || os.Geteuid() == 0
+}
+
+// xattrChanges compares the extended attributes of the file at path to
+// the ones of s.
+func (r *Receiver) xattrChanges(path string, s *SrcFile) (Changes, error) {
+	if !r.Opts.Xattrs && !r.Opts.ACLs || !hasXattrs(s.Mode) {
+		return 0, nil
+	}
+	cur, err := listXattrs(path, r.wantXattr)
+	if err != nil {
+		return 0, err
+	}
+	var c Changes
+	r.diffXattrs(s.Xattrs, cur, func(x Xattr, set bool) {
+		if isACL(x.Name) {
+			c |= ChangeACL
+		} else {
+			c |= ChangeXattrs
+		}
+	})
+	return c, nil
+}
+
+// setXattrs applies the extended attributes of s to the file at path,
+// and removes the ones s does not have.
+func (r *Receiver) setXattrs(path string, s *SrcFile) error {
+	if !r.Opts.Xattrs && !r.Opts.ACLs || !hasXattrs(s.Mode) {
+		return nil
+	}
+	cur, err := listXattrs(path, r.wantXattr)
+	if err != nil {
+		return err
+	}
+	r.diffXattrs(s.Xattrs, cur, func(x Xattr, set bool) {
+		if err != nil {
+			return
+		}
+		if set {
+			err = setXattr(path, x)
+		} else {
+			err = removeXattr(path, x.Name)
+		}
+	})
+	return err
+}
+
+// diffXattrs calls f with set true for each of the extended attributes
+// in src, applied by the receiver, that cur lacks or has another value
+// of, and with set false for each of the ones in cur that src lacks.
+// Both lists are sorted by name.
+func (r *Receiver) diffXattrs(src, cur []Xattr, f func(x Xattr, set bool)) {
+	for len(src) > 0 || len(cur) > 0 {
+		switch {
+		case len(src) > 0 && !r.wantXattr(src[0].Name):
+			src = src[1:]
+		case len(cur) == 0 || len(src) > 0 && src[0].Name < cur[0].Name:
+			f(src[0], true)
+			src = src[1:]
+		case len(src) == 0 || cur[0].Name < src[0].Name:
+			f(cur[0], false)
+			cur = cur[1:]
+		default:
+			if !bytes.Equal(src[0].Value, cur[0].Value) {
+				f(src[0], true)
+			}
+			src, cur = src[1:], cur[1:]
+		}
+	}
+}
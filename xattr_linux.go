@@ -0,0 +1,70 @@
+package psync
+
+import (
+	"bytes"
+	"sort"
+
+	"golang.org/x/sys/unix"
+)
+
+// listXattrs returns the extended attributes of the file at path, not
+// following symbolic links, whose names are accepted by want, sorted by
+// name.
+func listXattrs(path string, want func(name string) bool) ([]Xattr, error) {
+	buf, err := xattrBuf(func(b []byte) (int, error) { return unix.Llistxattr(path, b) })
+	if err == unix.ENOTSUP {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, name := range bytes.Split(buf, []byte{0}) {
+		if len(name) > 0 && want(string(name)) {
+			names = append(names, string(name))
+		}
+	}
+	sort.Strings(names)
+	var xattrs []Xattr
+	for _, name := range names {
+		value, err := xattrBuf(func(b []byte) (int, error) { return unix.Lgetxattr(path, name, b) })
+		if err == unix.ENODATA {
+			// removed in the meantime
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		xattrs = append(xattrs, Xattr{Name: name, Value: value})
+	}
+	return xattrs, nil
+}
+
+// xattrBuf calls get, which fills a buffer like listxattr(2) and
+// getxattr(2) do, with a buffer large enough for the result.
+func xattrBuf(get func([]byte) (int, error)) ([]byte, error) {
+	for {
+		n, err := get(nil)
+		if err != nil || n == 0 {
+			return nil, err
+		}
+		b := make([]byte, n)
+		n, err = get(b)
+		if err == unix.ERANGE {
+			// grown in the meantime
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+
+func setXattr(path string, x Xattr) error {
+	return unix.Lsetxattr(path, x.Name, x.Value, 0)
+}
+
+func removeXattr(path, name string) error {
+	return unix.Lremovexattr(path, name)
+}
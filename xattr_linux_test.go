@@ -0,0 +1,119 @@
+package psync
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/sys/unix"
+)
+
+func TestXattrs(t *testing.T) {
+	root, err := ioutil.TempDir("", "psync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	src, dst := filepath.Join(root, "src"), filepath.Join(root, "dst")
+	mtime := time.Now().Truncate(time.Second)
+	for _, dir := range []string{src, dst} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		name := filepath.Join(dir, "file")
+		if err := ioutil.WriteFile(name, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(name, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	set := func(name string, xattrs ...Xattr) {
+		for _, x := range xattrs {
+			err := setXattr(filepath.Join(root, name), x)
+			if err == unix.ENOTSUP {
+				t.Skip("extended attributes are not supported")
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	set("src/file", Xattr{"user.a", []byte("1")}, Xattr{"user.b", []byte("2")})
+	set("dst/file", Xattr{"user.b", []byte("old")}, Xattr{"user.c", []byte("3")})
+
+	lis := SrcFileLister{Root: src, Xattrs: true}
+	files, err := lis.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Xattr{{"user.a", []byte("1")}, {"user.b", []byte("2")}}
+	if len(files) != 1 {
+		t.Fatalf("List() = %v, want a single file", files)
+	}
+	if diff := cmp.Diff(want, files[0].Xattrs); diff != "" {
+		t.Errorf("List() xattrs mismatch (-want +got):\n%s", diff)
+	}
+
+	// the contents are up to date, only the xattrs need to be applied
+	list := []ReceiverSrcFile{{SrcFile: files[0].SrcFile}}
+	rcv := Receiver{Root: dst, Opts: Options{Xattrs: true}}
+	var enc mergeDscEnc
+	if _, err := rcv.SendDstFileList(8, list, &enc); err != nil {
+		t.Fatal(err)
+	}
+	if list[0].state != DstFileIdentical || list[0].changes != ChangeXattrs {
+		t.Errorf("got state %v, changes %v, want identical with changed xattrs", list[0].state, list[0].changes)
+	}
+	var res Result
+	if err := rcv.FinishAttrs(list, &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Failed) != 0 {
+		t.Fatal(res.Failed)
+	}
+	got, err := listXattrs(filepath.Join(dst, "file"), xattrFilter(true, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("applied xattrs mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestXattrsChown(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("file capabilities require root")
+	}
+	root, err := ioutil.TempDir("", "psync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	name := filepath.Join(root, "file")
+	if err := ioutil.WriteFile(name, nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// cap_net_raw+ep, in the revision 2 format
+	capNetRaw := []byte{1, 0, 0, 2, 0, 0x20, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	want := []Xattr{{"security.capability", capNetRaw}}
+	rcv := Receiver{Root: root, Opts: Options{Owner: true, Group: true, Xattrs: true}}
+	err = rcv.setAttrs(&ReceiverSrcFile{SrcFile: SrcFile{Path: "file", Mode: 0755, Xattrs: want}})
+	if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EINVAL) {
+		t.Skipf("file capabilities are not supported: %v", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := listXattrs(name, rcv.wantXattr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("xattrs mismatch after chown (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package psync
+
+import "errors"
+
+var errXattrs = errors.New("extended attributes are not supported on this platform")
+
+func listXattrs(path string, want func(name string) bool) ([]Xattr, error) {
+	return nil, errXattrs
+}
+
+func setXattr(path string, x Xattr) error { return errXattrs }
+
+func removeXattr(path, name string) error { return errXattrs }